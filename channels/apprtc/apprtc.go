@@ -1,6 +1,7 @@
 package apprtc
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -26,11 +27,20 @@ func New() channels.Channel {
 
 // Recv receives a message at the given key.
 func (c *apprtcChannel) Recv(key string) (data string, err error) {
-	conn, err := c.getConnection(key, "recv")
+	return c.RecvContext(context.Background(), key)
+}
+
+// RecvContext receives a message at the given key, stopping when ctx is done.
+func (c *apprtcChannel) RecvContext(ctx context.Context, key string) (data string, err error) {
+	conn, err := c.getConnection(ctx, key, "recv")
 	if err != nil {
 		return "", err
 	}
 	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
 
 	var packet struct {
 		Message string `json:"msg"`
@@ -38,6 +48,9 @@ func (c *apprtcChannel) Recv(key string) (data string, err error) {
 	}
 	err = conn.ReadJSON(&packet)
 	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
 		return "", fmt.Errorf("error receiving packet: %w", err)
 	}
 
@@ -50,7 +63,7 @@ func (c *apprtcChannel) Recv(key string) (data string, err error) {
 
 // Send sends a message to the given key with the given data.
 func (c *apprtcChannel) Send(key, data string) error {
-	conn, err := c.getConnection(key, "send")
+	conn, err := c.getConnection(context.Background(), key, "send")
 	if err != nil {
 		return err
 	}
@@ -67,14 +80,14 @@ func (c *apprtcChannel) Send(key, data string) error {
 	return nil
 }
 
-func (c *apprtcChannel) getConnection(roomID, clientID string) (*websocket.Conn, error) {
+func (c *apprtcChannel) getConnection(ctx context.Context, roomID, clientID string) (*websocket.Conn, error) {
 	url := "wss://apprtc-ws.webrtc.org/ws"
-	conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, url, http.Header{
 		"Origin": {"https://appr.tc"},
 	})
 	if err != nil {
 		var msg string
-		if resp.Body != nil {
+		if resp != nil && resp.Body != nil {
 			bs, _ := ioutil.ReadAll(resp.Body)
 			msg = string(bs)
 		}
@@ -1,6 +1,7 @@
 package channels
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"sync"
@@ -12,6 +13,38 @@ type Channel interface {
 	Recv(key string) (data string, err error)
 }
 
+// A ContextChannel is a Channel which can stop receiving when a context is
+// done. A receive that is stopped doesn't consume a message.
+type ContextChannel interface {
+	Channel
+	RecvContext(ctx context.Context, key string) (data string, err error)
+}
+
+// RecvContext receives a message at the given key, stopping when ctx is done.
+// If ch isn't a ContextChannel the receive keeps running in the background once
+// ctx is done, and the message it receives is lost.
+func RecvContext(ctx context.Context, ch Channel, key string) (data string, err error) {
+	if cch, ok := ch.(ContextChannel); ok {
+		return cch.RecvContext(ctx, key)
+	}
+
+	type result struct {
+		data string
+		err  error
+	}
+	c := make(chan result, 1)
+	go func() {
+		data, err := ch.Recv(key)
+		c <- result{data: data, err: err}
+	}()
+	select {
+	case r := <-c:
+		return r.data, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
 // A Factory returns a Channel from an address
 type Factory = func(addr string) (Channel, error)
 
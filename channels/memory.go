@@ -1,6 +1,7 @@
 package channels
 
 import (
+	"context"
 	"sync"
 
 	"github.com/rs/zerolog/log"
@@ -37,9 +38,17 @@ func (mch *memoryChannel) Send(key, data string) error {
 }
 
 func (mch *memoryChannel) Recv(key string) (data string, err error) {
+	return mch.RecvContext(context.Background(), key)
+}
+
+func (mch *memoryChannel) RecvContext(ctx context.Context, key string) (data string, err error) {
 	log.Debug().Str("key", key).Msg("[MemoryChannel] receiving")
-	data = <-mch.getChannel(key)
-	return data, nil
+	select {
+	case data = <-mch.getChannel(key):
+		return data, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
 }
 
 func (mch *memoryChannel) getChannel(key string) chan string {
@@ -1,6 +1,7 @@
 package operator
 
 import (
+	"context"
 	"errors"
 	"io/ioutil"
 	"net"
@@ -37,15 +38,26 @@ func New(url string) channels.Channel {
 
 // Recv receives a message at the given key.
 func (c *operatorChannel) Recv(key string) (data string, err error) {
+	return c.RecvContext(context.Background(), key)
+}
+
+// RecvContext receives a message at the given key, stopping when ctx is done.
+func (c *operatorChannel) RecvContext(ctx context.Context, key string) (data string, err error) {
 	log.Debug().Str("url", c.url).Str("key", key).Msg("[operator] receive")
 
 	uv := url.Values{
 		"address": {key},
 	}
 	for {
-		req, _ := http.NewRequest("GET", c.url+"/sub?"+uv.Encode(), nil)
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		req, _ := http.NewRequestWithContext(ctx, "GET", c.url+"/sub?"+uv.Encode(), nil)
 		resp, err := c.do(req)
 		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
 			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
 				log.Warn().Msg("[operator] timed-out, retrying")
 				continue
@@ -6,6 +6,8 @@ import (
 	"github.com/kirsle/configdir"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/channels"
+	"github.com/rtctunnel/rtctunnel/signal"
 	"github.com/spf13/cobra"
 )
 
@@ -43,3 +45,14 @@ func defaultConfigFile() string {
 	}
 	return filepath.Join(dir, "rtctunnel.yaml")
 }
+
+// configureSignalChannel sets the default signal channel from the config.
+func configureSignalChannel(cfg *Config) {
+	if cfg.SignalChannel != "" {
+		ch, err := channels.Get(cfg.SignalChannel)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid signalchannel in yaml config")
+		}
+		signal.SetDefaultOptions(signal.WithChannel(ch))
+	}
+}
@@ -9,6 +9,7 @@ import (
 func init() {
 	var localPort, remotePort int
 	var localPeer, remotePeer string
+	var remoteService string
 	var routeType string
 
 	addRouteCmd := &cobra.Command{
@@ -24,9 +25,9 @@ func init() {
 				cmd.Usage()
 				log.Fatal().Msg("local-port is required")
 			}
-			if remotePort == 0 {
+			if (remotePort == 0) == (remoteService == "") {
 				cmd.Usage()
-				log.Fatal().Msg("remote-port is required")
+				log.Fatal().Msg("one of remote-port or remote-service is required")
 			}
 			if localPeer == "" {
 				localPeer = cfg.KeyPair.Public.String()
@@ -52,10 +53,15 @@ func init() {
 				Str("local-peer", localPeer).
 				Str("remote-peer", remotePeer).
 				Int("remote-port", remotePort).
+				Str("remote-service", remoteService).
 				Str("type", routeType).
 				Msg("adding route")
 
-			err = cfg.AddRoute(localPort, localPeerKey, remotePeerKey, remotePort, RouteType(routeType))
+			if remoteService != "" {
+				err = cfg.AddServiceRoute(localPort, localPeerKey, remotePeerKey, remoteService, RouteType(routeType))
+			} else {
+				err = cfg.AddRoute(localPort, localPeerKey, remotePeerKey, remotePort, RouteType(routeType))
+			}
 			if err != nil {
 				log.Fatal().Err(err).Msg("failed to add route")
 			}
@@ -70,6 +76,7 @@ func init() {
 	addRouteCmd.PersistentFlags().StringVarP(&localPeer, "local-peer", "", "", "the local peer")
 	addRouteCmd.PersistentFlags().StringVarP(&remotePeer, "remote-peer", "", "", "the remote peer")
 	addRouteCmd.PersistentFlags().IntVarP(&remotePort, "remote-port", "", 0, "the remote port to connect to")
+	addRouteCmd.PersistentFlags().StringVarP(&remoteService, "remote-service", "", "", "the remote service to connect to, instead of a port")
 	addRouteCmd.PersistentFlags().StringVarP(&routeType, "type", "", "TCP", "the route type (TCP or UDP)")
 	rootCmd.AddCommand(addRouteCmd)
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	var name, address string
+	var serviceType string
+
+	addServiceCmd := &cobra.Command{
+		Use:   "add-service",
+		Short: "add a named service that routes can connect to",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config")
+			}
+
+			if name == "" {
+				cmd.Usage()
+				log.Fatal().Msg("name is required")
+			}
+			if address == "" {
+				cmd.Usage()
+				log.Fatal().Msg("address is required")
+			}
+
+			log.Info().
+				Str("config-file", options.configFile).
+				Str("name", name).
+				Str("address", address).
+				Str("type", serviceType).
+				Msg("adding service")
+
+			err = cfg.AddService(name, address, RouteType(serviceType))
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to add service")
+			}
+
+			err = cfg.Save(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to save config")
+			}
+		},
+	}
+	addServiceCmd.PersistentFlags().StringVarP(&name, "name", "", "", "the service name, eg. ssh")
+	addServiceCmd.PersistentFlags().StringVarP(&address, "address", "", "", "the address to connect to, eg. 127.0.0.1:22")
+	addServiceCmd.PersistentFlags().StringVarP(&serviceType, "type", "", "TCP", "the service type (TCP or UDP)")
+	rootCmd.AddCommand(addServiceCmd)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/spf13/cobra"
+)
+
+var identityCmd = &cobra.Command{
+	Use:   "identity",
+	Short: "Manages identities shared by multiple devices",
+	Long: "Manages identities shared by multiple devices.\n\n" +
+		"An identity signs a list of device keys. Peers import the device list and use the\n" +
+		"identity key in their routes, then connect to whichever device answers first.",
+}
+
+func init() {
+	identityCmd.AddCommand(&cobra.Command{
+		Use:   "init",
+		Short: "Creates a new identity with this device as its only device",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+			if cfg.IdentityKeyPair != nil {
+				log.Fatal().Msg("config already has an identity")
+			}
+
+			identity := crypt.GenerateIdentityKeyPair()
+			list := identity.SignDeviceList([]crypt.Key{cfg.KeyPair.Public}, 1)
+			cfg.IdentityKeyPair = &identity
+			cfg.Identity = &list
+
+			log.Info().
+				Str("config-file", options.configFile).
+				Str("identity", identity.Public.String()).
+				Msg("created identity")
+
+			saveIdentity(cfg)
+		},
+	})
+
+	identityCmd.AddCommand(&cobra.Command{
+		Use:   "add-device <public-key>",
+		Short: "Authorizes a device to act for the identity and prints the new device list",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			updateDevices(args[0], func(devices []crypt.Key, device crypt.Key) []crypt.Key {
+				for _, d := range devices {
+					if d == device {
+						return devices
+					}
+				}
+				return append(devices, device)
+			})
+		},
+	})
+
+	identityCmd.AddCommand(&cobra.Command{
+		Use:   "remove-device <public-key>",
+		Short: "Revokes a device from the identity and prints the new device list",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			updateDevices(args[0], func(devices []crypt.Key, device crypt.Key) []crypt.Key {
+				var remaining []crypt.Key
+				for _, d := range devices {
+					if d != device {
+						remaining = append(remaining, d)
+					}
+				}
+				return remaining
+			})
+		},
+	})
+
+	identityCmd.AddCommand(&cobra.Command{
+		Use:   "export",
+		Short: "Prints the device list of this device's identity",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+			if cfg.Identity == nil {
+				log.Fatal().Msg("this device doesn't belong to an identity")
+			}
+			printDeviceList(cfg.Identity)
+		},
+	})
+
+	identityCmd.AddCommand(&cobra.Command{
+		Use:   "import [file]",
+		Short: "Imports a device list from a file or stdin",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+
+			var r io.Reader = os.Stdin
+			if len(args) > 0 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to open device list")
+				}
+				defer f.Close()
+				r = f
+			}
+
+			var list crypt.DeviceList
+			err = json.NewDecoder(r).Decode(&list)
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid device list")
+			}
+
+			err = cfg.AddDeviceList(list)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to import device list")
+			}
+
+			log.Info().
+				Str("config-file", options.configFile).
+				Str("identity", list.Identity.String()).
+				Interface("devices", list.Devices).
+				Uint64("version", list.Version).
+				Msg("imported device list")
+
+			saveIdentity(cfg)
+		},
+	})
+
+	rootCmd.AddCommand(identityCmd)
+}
+
+func updateDevices(publicKey string, update func(devices []crypt.Key, device crypt.Key) []crypt.Key) {
+	cfg, err := LoadConfig(options.configFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load config file")
+	}
+	if cfg.IdentityKeyPair == nil || cfg.Identity == nil {
+		log.Fatal().Msg("config has no identity, run identity init first")
+	}
+
+	device, err := crypt.NewKey(publicKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid device key")
+	}
+
+	devices := update(cfg.Identity.Devices, device)
+	if len(devices) == 0 {
+		log.Fatal().Msg("an identity must have at least one device")
+	}
+	list := cfg.IdentityKeyPair.SignDeviceList(devices, cfg.Identity.Version+1)
+	err = cfg.AddDeviceList(list)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to update device list")
+	}
+
+	saveIdentity(cfg)
+	printDeviceList(&list)
+}
+
+func saveIdentity(cfg *Config) {
+	err := cfg.Save(options.configFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to save config file")
+	}
+}
+
+func printDeviceList(list *crypt.DeviceList) {
+	bs, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to encode device list")
+	}
+	fmt.Println(string(bs))
+}
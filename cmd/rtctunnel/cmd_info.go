@@ -18,11 +18,25 @@ func init() {
 			}
 
 			fmt.Printf("public-key: %s\n", cfg.KeyPair.Public)
+			fmt.Printf("public-key (checksummed): %s\n", cfg.KeyPair.Public.Checksummed())
+			if cfg.Identity != nil {
+				fmt.Printf("identity: %s\n", cfg.Identity.Identity)
+			}
 			fmt.Printf("routes: \n")
 			for _, route := range cfg.Routes {
-				fmt.Printf("  %s:%d -> %s:%d\n",
+				remote := fmt.Sprint(route.RemotePort)
+				if route.RemoteService != "" {
+					remote = route.RemoteService
+				}
+				fmt.Printf("  %s:%d -> %s:%s\n",
 					route.LocalPeer, route.LocalPort,
-					route.RemotePeer, route.RemotePort)
+					route.RemotePeer, remote)
+			}
+			if len(cfg.Services) > 0 {
+				fmt.Printf("services: \n")
+				for _, svc := range cfg.Services {
+					fmt.Printf("  %s -> %s\n", svc.Name, svc.Address)
+				}
 			}
 		},
 	}
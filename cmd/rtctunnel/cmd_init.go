@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"os"
+
 	"github.com/rs/zerolog/log"
 	"github.com/rtctunnel/rtctunnel/crypt"
 	"github.com/spf13/cobra"
 )
 
 func init() {
+	var keySource string
+	var fromMnemonic bool
+
 	initCmd := &cobra.Command{
 		Use:   "init",
 		Short: "Creates a new RTCTunnel config and stores it to disk",
@@ -18,8 +25,35 @@ func init() {
 					Msg("config file already exists. remove it if you want to re-initialize")
 			}
 
+			if keySource != "" && fromMnemonic {
+				cmd.Usage()
+				log.Fatal().Msg("key-source and from-mnemonic can't be used together")
+			}
+
 			cfg = new(Config)
-			cfg.KeyPair = crypt.GenerateKeyPair()
+			if keySource != "" {
+				cfg.KeySource = keySource
+				cfg.KeyPair, err = crypt.LoadKeyPair(keySource)
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to load key")
+				}
+			} else if fromMnemonic {
+				fmt.Fprintln(os.Stderr, "enter the 24 word recovery phrase:")
+				mnemonic, err := bufio.NewReader(os.Stdin).ReadString('\n')
+				if err != nil && mnemonic == "" {
+					log.Fatal().Err(err).Msg("failed to read recovery phrase")
+				}
+				cfg.KeyPair, err = crypt.KeyPairFromMnemonic(mnemonic)
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to recover key pair")
+				}
+			} else {
+				cfg.KeyPair = crypt.GenerateKeyPair()
+			}
+			if cfg.KeyPair.PostQuantum == nil {
+				// key sources and recovery phrases only hold the X25519 key
+				cfg.KeyPair.PostQuantum = crypt.GeneratePostQuantumKeyPair()
+			}
 
 			log.Info().
 				Str("public-key", cfg.KeyPair.Public.String()).
@@ -32,6 +66,8 @@ func init() {
 			}
 		},
 	}
+	initCmd.PersistentFlags().StringVarP(&keySource, "key-source", "", "", "load the private key from file:<path>, env:<name> or fd:<number> instead of storing it in the config")
+	initCmd.PersistentFlags().BoolVarP(&fromMnemonic, "from-mnemonic", "", false, "recover the key pair from a recovery phrase read from stdin")
 	rootCmd.AddCommand(initCmd)
 
 }
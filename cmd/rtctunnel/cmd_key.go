@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/spf13/cobra"
+)
+
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manages the key pair",
+}
+
+func init() {
+	var format string
+	var public, postQuantum bool
+
+	exportCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Prints the private (or public) key",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+
+			if postQuantum {
+				if !cfg.KeyPair.Private.Valid() {
+					log.Fatal().Msg("invalid config file, missing private key")
+				}
+				err = cfg.ensurePostQuantumKey(options.configFile)
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to save config file")
+				}
+				fmt.Println(cfg.KeyPair.PostQuantumKey())
+				return
+			}
+
+			key := cfg.KeyPair.Private
+			if public {
+				key = cfg.KeyPair.Public
+			}
+			if !key.Valid() {
+				log.Fatal().Msg("invalid config file, missing key")
+			}
+
+			str, err := key.Encode(crypt.Encoding(format), !public)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to encode key")
+			}
+			fmt.Println(strings.TrimSpace(str))
+		},
+	}
+	exportCmd.PersistentFlags().StringVarP(&format, "format", "", string(crypt.EncodingBase58), fmt.Sprintf("the key format (one of %v)", crypt.Encodings))
+	exportCmd.PersistentFlags().BoolVarP(&public, "public", "", false, "export the public key instead of the private key")
+	exportCmd.PersistentFlags().BoolVarP(&postQuantum, "post-quantum", "", false, "export the post-quantum public key, for peers to import with key import --peer")
+	keyCmd.AddCommand(exportCmd)
+}
+
+func init() {
+	var format, peerKey string
+
+	importCmd := &cobra.Command{
+		Use:   "import [file]",
+		Short: "Replaces the key pair with a private key read from a file or stdin",
+		Long: "Replaces the key pair with a private key read from a file or stdin.\n\n" +
+			"With --peer, stores that peer's post-quantum key instead, as printed by\n" +
+			"key export --post-quantum on the peer.",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+			if peerKey == "" && cfg.KeySource != "" {
+				log.Fatal().Str("key-source", cfg.KeySource).Msg("the config uses an external key source, update the key there instead")
+			}
+
+			var r io.Reader = os.Stdin
+			if len(args) > 0 && args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to open key file")
+				}
+				defer f.Close()
+				r = f
+			}
+			bs, err := io.ReadAll(r)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to read key")
+			}
+
+			if peerKey != "" {
+				peerPublicKey, err := crypt.NewKey(peerKey)
+				if err != nil {
+					log.Fatal().Err(err).Msg("invalid peer key")
+				}
+				pqKey, err := crypt.ParsePostQuantumKey(string(bs))
+				if err != nil {
+					log.Fatal().Err(err).Msg("invalid key")
+				}
+				cfg.SetPeerPostQuantumKey(peerPublicKey, pqKey)
+
+				log.Info().
+					Str("config-file", options.configFile).
+					Str("peer", peerPublicKey.String()).
+					Msg("imported peer post-quantum key")
+
+				err = cfg.Save(options.configFile)
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to save config file")
+				}
+				return
+			}
+
+			keypair, err := crypt.DecodeKeyPair(crypt.Encoding(format), string(bs))
+			if err != nil {
+				log.Fatal().Err(err).Msg("invalid key")
+			}
+
+			// the imported key pair is a new identity, so it gets a new
+			// post-quantum key pair too
+			keypair.PostQuantum = crypt.GeneratePostQuantumKeyPair()
+			prev := cfg.KeyPair
+			cfg.KeyPair = keypair
+			cfg.replaceKey(prev.Public, keypair.Public)
+
+			log.Info().
+				Str("config-file", options.configFile).
+				Str("public-key", keypair.Public.String()).
+				Msg("imported key pair")
+
+			err = cfg.Save(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to save config file")
+			}
+		},
+	}
+	importCmd.PersistentFlags().StringVarP(&format, "format", "", "", fmt.Sprintf("the key format (one of %v), detected if empty", crypt.Encodings))
+	importCmd.PersistentFlags().StringVarP(&peerKey, "peer", "", "", "import the post-quantum key of the peer with this public key")
+	keyCmd.AddCommand(importCmd)
+
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Prints a recovery phrase the key pair can be restored from with init --from-mnemonic",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+
+			mnemonic, err := cfg.KeyPair.Mnemonic()
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to create recovery phrase")
+			}
+			fmt.Println(mnemonic)
+		},
+	}
+	keyCmd.AddCommand(backupCmd)
+
+	rootCmd.AddCommand(keyCmd)
+}
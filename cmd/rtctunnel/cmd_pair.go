@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/rtctunnel/rtctunnel/pair"
+	"github.com/rtctunnel/rtctunnel/signal"
+	"github.com/spf13/cobra"
+)
+
+// A pairRoute is a route requested during pairing. The peer which sent it is the
+// local peer.
+type pairRoute struct {
+	LocalPort  int
+	RemotePort int
+	Type       RouteType
+}
+
+// pairInfo is the information sent to the peer during pairing.
+type pairInfo struct {
+	Routes []pairRoute `json:",omitempty"`
+	// PostQuantumKey is the sender's post-quantum key, so the peer can use
+	// hybrid encryption from the first signal message
+	PostQuantumKey crypt.PostQuantumKey `json:",omitempty"`
+}
+
+func init() {
+	var localPort, remotePort int
+	var routeType string
+	var acceptRoutes bool
+
+	pairCmd := &cobra.Command{
+		Use:   "pair [code]",
+		Short: "Exchanges public keys with a peer using a short one-time code",
+		Long: "Exchanges public keys with a peer using a short one-time code.\n\n" +
+			"Run without a code to generate one, then run with that code on the peer.\n" +
+			"If ports are given a matching route is added on both sides. The routes\n" +
+			"requested by the peer are shown and must be confirmed, unless\n" +
+			"--accept-routes is used.",
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+			err = cfg.ensurePostQuantumKey(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to save config file")
+			}
+
+			if (localPort == 0) != (remotePort == 0) {
+				cmd.Usage()
+				log.Fatal().Msg("local-port and remote-port must be used together")
+			}
+			var routes []pairRoute
+			if localPort != 0 {
+				r := pairRoute{
+					LocalPort:  localPort,
+					RemotePort: remotePort,
+					Type:       RouteType(routeType),
+				}
+				if err := r.route().Validate(); err != nil {
+					log.Fatal().Err(err).Msg("invalid route")
+				}
+				routes = append(routes, r)
+			}
+			info, err := json.Marshal(pairInfo{
+				Routes:         routes,
+				PostQuantumKey: cfg.KeyPair.PostQuantumKey(),
+			})
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to encode routes")
+			}
+
+			configureSignalChannel(cfg)
+			ch, err := signal.Channel()
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to get signal channel")
+			}
+
+			var result *pair.Result
+			if len(args) == 0 {
+				code := pair.GenerateCode()
+				fmt.Printf("pairing code: %s\n", code)
+				fmt.Printf("on the other peer run: rtctunnel pair %s\n", code)
+				result, err = pair.Start(ch, code, cfg.KeyPair.Public, info)
+			} else {
+				result, err = pair.Join(ch, args[0], cfg.KeyPair.Public, info)
+			}
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to pair")
+			}
+
+			var peerInfo pairInfo
+			if strings.HasPrefix(string(result.Info), "[") {
+				// peers used to only send their routes
+				err = json.Unmarshal(result.Info, &peerInfo.Routes)
+			} else {
+				err = json.Unmarshal(result.Info, &peerInfo)
+			}
+			if err != nil {
+				log.Fatal().Err(err).Msg("peer sent invalid routes")
+			}
+			peerRoutes := peerInfo.Routes
+			if len(peerInfo.PostQuantumKey) > 0 {
+				if !peerInfo.PostQuantumKey.Valid() {
+					log.Fatal().Msg("peer sent an invalid post-quantum key")
+				}
+				cfg.SetPeerPostQuantumKey(result.PeerPublicKey, peerInfo.PostQuantumKey)
+			}
+			for _, r := range peerRoutes {
+				if err := r.route().Validate(); err != nil {
+					log.Fatal().Err(err).Msg("peer sent invalid routes")
+				}
+			}
+			if len(peerRoutes) > 0 && !acceptRoutes && !confirmPeerRoutes(peerRoutes) {
+				log.Warn().Msg("not adding the routes requested by the peer")
+				peerRoutes = nil
+			}
+
+			for _, r := range routes {
+				err = cfg.AddRoute(r.LocalPort, cfg.KeyPair.Public, result.PeerPublicKey, r.RemotePort, r.Type)
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to add route")
+				}
+			}
+			for _, r := range peerRoutes {
+				err = cfg.AddRoute(r.LocalPort, result.PeerPublicKey, cfg.KeyPair.Public, r.RemotePort, r.Type)
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to add route")
+				}
+			}
+
+			log.Info().
+				Str("config-file", options.configFile).
+				Str("peer", result.PeerPublicKey.String()).
+				Interface("routes", routes).
+				Interface("peer-routes", peerRoutes).
+				Msg("paired with peer")
+
+			err = cfg.Save(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to save config file")
+			}
+
+			fmt.Printf("peer public-key: %s\n", result.PeerPublicKey)
+		},
+	}
+	pairCmd.PersistentFlags().IntVarP(&localPort, "local-port", "", 0, "the local port of a route to add on both peers")
+	pairCmd.PersistentFlags().IntVarP(&remotePort, "remote-port", "", 0, "the remote port of a route to add on both peers")
+	pairCmd.PersistentFlags().StringVarP(&routeType, "type", "", "TCP", "the route type (TCP or UDP)")
+	pairCmd.PersistentFlags().BoolVarP(&acceptRoutes, "accept-routes", "", false, "add the routes requested by the peer without asking")
+	rootCmd.AddCommand(pairCmd)
+}
+
+func (r pairRoute) route() Route {
+	return Route{LocalPort: r.LocalPort, RemotePort: r.RemotePort, Type: r.Type}
+}
+
+// confirmPeerRoutes asks whether to add the routes requested by the peer. Each
+// one lets the peer connect to a local port.
+func confirmPeerRoutes(routes []pairRoute) bool {
+	fmt.Fprintln(os.Stderr, "the peer requested access to these local ports:")
+	for _, r := range routes {
+		fmt.Fprintf(os.Stderr, "  %s %d (peer port %d)\n", r.route().Protocol(), r.RemotePort, r.LocalPort)
+	}
+	fmt.Fprint(os.Stderr, "add these routes? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
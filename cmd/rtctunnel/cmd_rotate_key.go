@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/rtctunnel/rtctunnel/signal"
+	"github.com/spf13/cobra"
+)
+
+// rotationTopic is the signal topic used to announce key rotations.
+const rotationTopic = "rotate-key"
+
+func init() {
+	var gracePeriod time.Duration
+
+	rotateKeyCmd := &cobra.Command{
+		Use:   "rotate-key",
+		Short: "Replaces the key pair and announces the new key to peers",
+		Run: func(cmd *cobra.Command, args []string) {
+			cfg, err := LoadConfig(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to load config file")
+			}
+
+			if !cfg.KeyPair.Private.Valid() {
+				log.Fatal().Msg("invalid config file, missing private key")
+			}
+			if cfg.KeySource != "" {
+				log.Fatal().Str("key-source", cfg.KeySource).Msg("the config uses an external key source, rotating it is not supported")
+			}
+
+			configureSignalChannel(cfg)
+
+			prev := cfg.KeyPair
+			next := crypt.GenerateKeyPair()
+			expires := time.Now().Add(gracePeriod)
+			peers := cfg.Peers()
+
+			cfg.PruneRetiredKeyPairs(time.Now())
+			cfg.RotateKeyPair(next, expires)
+
+			// save before announcing so the new key is never lost
+			err = cfg.Save(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to save config file")
+			}
+
+			log.Info().
+				Str("config-file", options.configFile).
+				Str("old-public-key", prev.Public.String()).
+				Str("public-key", next.Public.String()).
+				Time("expires", expires).
+				Msg("rotated key pair")
+
+			for _, peerPublicKey := range peers {
+				bs, err := json.Marshal(crypt.NewRotation(prev, next, peerPublicKey, expires))
+				if err != nil {
+					log.Fatal().Err(err).Msg("failed to encode key rotation")
+				}
+
+				err = signal.Send(prev, peerPublicKey, bs, signal.WithTopic(rotationTopic))
+				if err != nil {
+					log.Warn().Err(err).
+						Str("peer", peerPublicKey.String()).
+						Msg("failed to announce key rotation, the peer must update its routes manually")
+					continue
+				}
+
+				log.Info().
+					Str("peer", peerPublicKey.String()).
+					Msg("announced key rotation")
+			}
+		},
+	}
+	rotateKeyCmd.PersistentFlags().DurationVarP(&gracePeriod, "grace-period", "", 7*24*time.Hour, "how long the old key remains valid")
+	rootCmd.AddCommand(rotateKeyCmd)
+}
+
+// watchKeyRotations waits for key rotation announcements from a peer and, if
+// the config allows it, updates the routes in the config file.
+func watchKeyRotations(cfg *Config, peerPublicKey crypt.Key) {
+	for {
+		bs, err := signal.Recv(cfg.KeyPair, peerPublicKey, signal.WithTopic(rotationTopic))
+		if err != nil {
+			log.Warn().Err(err).Str("peer", peerPublicKey.String()).Msg("failed to receive key rotation")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		var rotation crypt.Rotation
+		err = json.Unmarshal(bs, &rotation)
+		if err != nil {
+			log.Warn().Err(err).Str("peer", peerPublicKey.String()).Msg("invalid key rotation")
+			continue
+		}
+
+		if rotation.Old != peerPublicKey {
+			log.Warn().Str("peer", peerPublicKey.String()).Msg("invalid key rotation: sent by a different key")
+			continue
+		}
+
+		err = rotation.Verify(cfg.KeyPair)
+		if err != nil {
+			log.Warn().Err(err).Str("peer", peerPublicKey.String()).Msg("invalid key rotation")
+			continue
+		}
+
+		if !cfg.AcceptKeyRotation {
+			log.Warn().
+				Str("peer", peerPublicKey.String()).
+				Str("new-peer", rotation.New.String()).
+				Time("expires", rotation.Expires).
+				Msg("peer rotated its key, but acceptkeyrotation is disabled. routes must be updated manually")
+			continue
+		}
+
+		// reload the config from disk so we only change the routes
+		latest, err := LoadConfig(options.configFile)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to load config file")
+			continue
+		}
+		if !latest.ApplyRotation(rotation) {
+			continue
+		}
+		err = latest.Save(options.configFile)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to save config file")
+			continue
+		}
+
+		log.Info().
+			Str("config-file", options.configFile).
+			Str("peer", peerPublicKey.String()).
+			Str("new-peer", rotation.New.String()).
+			Time("expires", rotation.Expires).
+			Msg("peer rotated its key, updated routes. restart to connect with the new key")
+	}
+}
@@ -8,8 +8,8 @@ import (
 	"net"
 	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	"github.com/rtctunnel/rtctunnel/channels"
 	_ "github.com/rtctunnel/rtctunnel/channels/operator"
 	"github.com/rtctunnel/rtctunnel/crypt"
 	"github.com/rtctunnel/rtctunnel/peer"
@@ -30,6 +30,10 @@ func init() {
 			if !cfg.KeyPair.Private.Valid() {
 				log.Fatal().Err(err).Msg("invalid config file, missing private key")
 			}
+			err = cfg.ensurePostQuantumKey(options.configFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to save config file")
+			}
 
 			log.Info().
 				Str("config-file", options.configFile).
@@ -38,36 +42,55 @@ func init() {
 				Str("signal-channel", cfg.SignalChannel).
 				Msg("using config")
 
-			if cfg.SignalChannel != "" {
-				ch, err := channels.Get(cfg.SignalChannel)
-				if err != nil {
-					log.Fatal().Err(err).Msg("invalid signalchannel in yaml config")
+			configureSignalChannel(cfg)
+
+			cfg.PruneRetiredKeyPairs(time.Now())
+			for _, rkp := range cfg.RetiredKeyPairs {
+				for _, peerPublicKey := range rkp.Peers {
+					go acceptRetired(cfg, rkp, peerPublicKey)
 				}
-				signal.SetDefaultOptions(signal.WithChannel(ch))
 			}
+			for _, peerPublicKey := range cfg.Peers() {
+				if cfg.DeviceList(peerPublicKey) != nil {
+					// identities announce new devices with a new device list instead
+					continue
+				}
+				go watchKeyRotations(cfg, peerPublicKey)
+			}
+
+			// cache the shared keys used for signaling
+			session := crypt.NewSession(cfg.KeyPair)
 
 			peerConns := map[crypt.Key]*peer.Conn{}
 			for _, route := range cfg.Routes {
 				var peerPublicKey crypt.Key
-				if route.LocalPeer == cfg.KeyPair.Public {
+				if cfg.IsSelf(route.LocalPeer) {
 					peerPublicKey = route.RemotePeer
-				} else if route.RemotePeer == cfg.KeyPair.Public {
+				} else if cfg.IsSelf(route.RemotePeer) {
 					peerPublicKey = route.LocalPeer
 				}
 
 				conn, ok := peerConns[peerPublicKey]
 				if !ok {
 					var err error
-					conn, err = peer.Open(cfg.KeyPair, peerPublicKey)
+					options := append(dialOptions(cfg, peerPublicKey),
+						peer.WithSignalOptions(signal.WithSession(session)))
+					if list := cfg.DeviceList(peerPublicKey); list != nil {
+						conn, err = peer.OpenIdentity(cfg.KeyPair, *list, options...)
+					} else {
+						conn, err = peer.Open(cfg.KeyPair, peerPublicKey, options...)
+					}
 					if err != nil {
 						log.Fatal().Err(err).Msg("failed to open peer connection")
 					}
 					peerConns[peerPublicKey] = conn
 
+					go logEvents(conn)
 					go acceptRemote(cfg, conn)
+					go acceptRemotePackets(cfg, conn)
 				}
 
-				if route.LocalPeer == cfg.KeyPair.Public {
+				if cfg.IsSelf(route.LocalPeer) {
 					go localListener(conn, route)
 				}
 			}
@@ -80,31 +103,35 @@ func init() {
 
 func acceptRemote(cfg *Config, pc *peer.Conn) {
 	for {
-		remote, port, err := pc.Accept()
+		remote, target, err := pc.AcceptTarget()
 		if err != nil {
+			select {
+			case <-pc.Done():
+				return
+			default:
+			}
 			log.Error().Err(err).Msg("failed to accept remote connection")
 			continue
 		}
 
-		var route *Route
-		for _, r := range cfg.Routes {
-			if r.RemotePeer == cfg.KeyPair.Public && r.RemotePort == port {
-				route = &r
-				break
-			}
-		}
-
+		route := remoteRoute(cfg, target)
 		if route == nil {
-			log.Warn().Int("port", port).Msg("remote peer attempted to connect to disallowed port")
+			log.Warn().Stringer("target", target).Msg("remote peer attempted to connect to disallowed target")
+			remote.Close()
+			continue
+		}
+		address, err := routeAddress(cfg, *route)
+		if err != nil {
+			log.Warn().Err(err).Stringer("target", target).Msg("failed to resolve route")
 			remote.Close()
 			continue
 		}
 
 		switch route.Type {
 		case RouteTypeTCP, "":
-			acceptRemoteTCP(pc, *route, remote)
+			acceptRemoteTCP(address, remote)
 		case RouteTypeUDP:
-			acceptRemoteUDP(pc, *route, remote)
+			acceptRemoteUDP(address, remote)
 		default:
 			log.Fatal().Str("type", string(route.Type)).Msg("invalid route type")
 		}
@@ -112,20 +139,183 @@ func acceptRemote(cfg *Config, pc *peer.Conn) {
 	}
 }
 
-func acceptRemoteTCP(pc *peer.Conn, route Route, remote net.Conn) {
-	local, err := net.Dial("tcp", net.JoinHostPort(options.bindAddress, fmt.Sprint(route.RemotePort)))
+// logEvents logs the state changes of a peer connection until it's closed.
+func logEvents(pc *peer.Conn) {
+	events, _ := pc.Events()
+	for evt := range events {
+		var e *zerolog.Event
+		switch evt.Type {
+		case peer.EventDisconnected, peer.EventFailed:
+			e = log.Warn()
+		case peer.EventDataChannelOpened, peer.EventDataChannelClosed:
+			e = log.Debug().Str("label", evt.Label)
+		default:
+			e = log.Info()
+		}
+		e.Str("peer", evt.PeerPublicKey.String()).
+			Str("event", string(evt.Type)).
+			Msg("peer connection event")
+	}
+}
+
+// remoteRoute returns the route a peer may open target on, or nil. Older peers
+// only send a port, so routes of any type match, preferring TCP since newer
+// peers only open UDP routes with packet connections.
+func remoteRoute(cfg *Config, target peer.Target) *Route {
+	var match *Route
+	for _, r := range cfg.Routes {
+		if !cfg.IsSelf(r.RemotePeer) {
+			continue
+		}
+		if target.Service != "" && r.RemoteService != target.Service {
+			continue
+		} else if target.Service == "" && (r.RemoteService != "" || r.RemotePort != target.Port) {
+			continue
+		}
+
+		if target.Protocol != "" {
+			if r.Protocol() == target.Protocol {
+				return &r
+			}
+		} else if match == nil || r.Protocol() == peer.ProtocolTCP {
+			match = &r
+		}
+	}
+	return match
+}
+
+// routeAddress returns the local address a route from a peer connects to.
+func routeAddress(cfg *Config, route Route) (string, error) {
+	if route.RemoteService == "" {
+		return net.JoinHostPort(options.bindAddress, fmt.Sprint(route.RemotePort)), nil
+	}
+	svc := cfg.Service(route.RemoteService)
+	if svc == nil {
+		return "", fmt.Errorf("unknown service: %s", route.RemoteService)
+	}
+	if (svc.Type == RouteTypeUDP) != (route.Type == RouteTypeUDP) {
+		return "", fmt.Errorf("service %s is %s, not %s", svc.Name, svc.Type, route.Type)
+	}
+	return svc.Address, nil
+}
+
+// openRoute opens a stream to the remote end of a route. Routes to ports use
+// plain port labels, which older peers understand too.
+func openRoute(pc *peer.Conn, route Route) (net.Conn, error) {
+	if route.RemoteService != "" {
+		return pc.OpenTarget(route.Target())
+	}
+	return pc.Open(route.RemotePort)
+}
+
+// dialOptions returns the options used to connect to a peer.
+func dialOptions(cfg *Config, peerPublicKey crypt.Key) []peer.DialOption {
+	options := []peer.DialOption{
+		peer.WithICEServers(cfg.ICEServersFor(peerPublicKey)...),
+	}
+	if cfg.Multiplex {
+		options = append(options, peer.WithMultiplexing())
+	}
+	// all of them, since an identity's devices each have their own key
+	for _, pc := range cfg.PeerConfigs {
+		if len(pc.PostQuantumKey) > 0 {
+			options = append(options, peer.WithPeerPostQuantumKey(pc.Peer, pc.PostQuantumKey))
+		}
+	}
+	return options
+}
+
+// Opening a connection with a retired key pair is retried, backing off
+// exponentially between attempts.
+const (
+	minRetiredBackoff = time.Second
+	maxRetiredBackoff = time.Minute
+)
+
+// acceptRetired accepts connections from a peer which may still be using a
+// retired key pair, until the key pair expires. If the connection fails to
+// open, or closes before then, it's opened again.
+func acceptRetired(cfg *Config, rkp RetiredKeyPair, peerPublicKey crypt.Key) {
+	ctx, cancel := context.WithDeadline(context.Background(), rkp.Expires)
+	defer cancel()
+
+	backoff := minRetiredBackoff
+	for ctx.Err() == nil {
+		err := serveRetired(ctx, cfg, rkp, peerPublicKey)
+		if ctx.Err() != nil {
+			break
+		}
+		if err == nil {
+			log.Info().
+				Str("peer", peerPublicKey.String()).
+				Str("retired-key", rkp.KeyPair.Public.String()).
+				Msg("peer connection using retired key closed, reopening")
+			backoff = minRetiredBackoff
+			continue
+		}
+
+		log.Warn().Err(err).
+			Str("peer", peerPublicKey.String()).
+			Str("retired-key", rkp.KeyPair.Public.String()).
+			Dur("backoff", backoff).
+			Msg("failed to open peer connection with retired key")
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+		}
+		backoff *= 2
+		if backoff > maxRetiredBackoff {
+			backoff = maxRetiredBackoff
+		}
+	}
+
+	log.Info().
+		Str("peer", peerPublicKey.String()).
+		Str("retired-key", rkp.KeyPair.Public.String()).
+		Msg("retired key has expired")
+}
+
+// serveRetired opens a connection with a retired key pair and accepts
+// connections from the peer until it closes, or ctx is done.
+func serveRetired(ctx context.Context, cfg *Config, rkp RetiredKeyPair, peerPublicKey crypt.Key) error {
+	options := append(dialOptions(cfg, peerPublicKey), peer.WithContext(ctx))
+	conn, err := peer.Open(rkp.KeyPair, peerPublicKey, options...)
+	if err != nil {
+		return err
+	}
+	log.Info().
+		Str("peer", peerPublicKey.String()).
+		Str("retired-key", rkp.KeyPair.Public.String()).
+		Msg("peer connected using retired key")
+	stop := context.AfterFunc(ctx, func() {
+		log.Info().
+			Str("peer", peerPublicKey.String()).
+			Str("retired-key", rkp.KeyPair.Public.String()).
+			Msg("retired key has expired, closing peer connection")
+		_ = conn.Close()
+	})
+	defer stop()
+
+	go logEvents(conn)
+	go acceptRemotePackets(cfg, conn)
+	acceptRemote(cfg, conn)
+	return nil
+}
+
+func acceptRemoteTCP(address string, remote net.Conn) {
+	local, err := net.Dial("tcp", address)
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to establish connection to local port")
 		remote.Close()
+		return
 	}
 	go joinConns(local, remote)
 }
 
-func acceptRemoteUDP(pc *peer.Conn, route Route, remote net.Conn) {
-	local, err := net.DialUDP("udp", nil, &net.UDPAddr{
-		IP:   net.ParseIP(options.bindAddress),
-		Port: route.RemotePort,
-	})
+// acceptRemoteUDP relays UDP packets sent over a stream, as peers did before
+// each UDP client got its own flow.
+func acceptRemoteUDP(address string, remote net.Conn) {
+	local, err := net.Dial("udp", address)
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to establish connection to local port")
 		remote.Close()
@@ -164,7 +354,7 @@ func localTCPListener(pc *peer.Conn, route Route) {
 			log.Fatal().Err(err).Msg("error accepting connection")
 		}
 
-		remote, err := pc.Open(route.RemotePort)
+		remote, err := openRoute(pc, route)
 		if err != nil {
 			local.Close()
 			log.Warn().Err(err).Msg("failed to create data channel")
@@ -175,39 +365,47 @@ func localTCPListener(pc *peer.Conn, route Route) {
 	}
 }
 
-func localUDPListener(pc *peer.Conn, route Route) {
-	local, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.ParseIP(options.bindAddress),
-		Port: route.LocalPort,
-	})
-	if err != nil {
-		log.Fatal().Err(err).Msg("error listening for UDP packets")
-	}
-
-	remote, err := pc.Open(route.RemotePort)
-	if err != nil {
-		_ = local.Close()
-		log.Fatal().Err(err).Msg("error opening remote connection")
-	}
-
-	go joinConns(local, remote)
-}
-
 func joinConns(c1, c2 net.Conn) {
 	defer c1.Close()
 	defer c2.Close()
 
 	errc := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(c1, c2)
-		errc <- err
+		errc <- copyConn(c1, c2)
 	}()
 	go func() {
-		_, err := io.Copy(c2, c1)
-		errc <- err
+		errc <- copyConn(c2, c1)
 	}()
-	err := <-errc
-	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
-		log.Warn().Err(err).Msg("error copying data between connections")
+
+	// when one side finishes writing, the other direction keeps going until
+	// it finishes too, unless the write side couldn't be closed on its own
+	for i := 0; i < 2; i++ {
+		err := <-errc
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, io.EOF) && !errors.Is(err, context.Canceled) {
+			log.Warn().Err(err).Msg("error copying data between connections")
+		}
+		return
+	}
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// copyConn copies from src to dst until src is done. When src ends cleanly, the
+// write side of dst is closed, so the end of stream reaches the other end. It
+// returns io.EOF if dst can't be half closed.
+func copyConn(dst, src net.Conn) error {
+	_, err := io.Copy(dst, src)
+	if err != nil {
+		return err
+	}
+	cw, ok := dst.(closeWriter)
+	if !ok {
+		return io.EOF
 	}
+	return cw.CloseWrite()
 }
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/rtctunnel/rtctunnel/peer"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -23,14 +27,101 @@ type Route struct {
 	LocalPeer  crypt.Key
 	RemotePeer crypt.Key
 	RemotePort int
-	Type       RouteType
+	// RemoteService is the name of a service on the remote peer, used instead
+	// of RemotePort
+	RemoteService string `json:",omitempty"`
+	Type          RouteType
+}
+
+// Protocol returns the peer.Target protocol for the route's type.
+func (r Route) Protocol() string {
+	if r.Type == RouteTypeUDP {
+		return peer.ProtocolUDP
+	}
+	return peer.ProtocolTCP
+}
+
+// Target returns what the local peer opens on the remote peer.
+func (r Route) Target() peer.Target {
+	if r.RemoteService != "" {
+		return peer.Target{Protocol: r.Protocol(), Service: r.RemoteService}
+	}
+	return peer.Target{Protocol: r.Protocol(), Port: r.RemotePort}
+}
+
+// Validate returns an error if the route's type or ports are invalid.
+func (r Route) Validate() error {
+	switch r.Type {
+	case RouteTypeTCP, RouteTypeUDP, "":
+	default:
+		return fmt.Errorf("invalid route type: %s", r.Type)
+	}
+	if r.LocalPort < 1 || r.LocalPort > 65535 {
+		return fmt.Errorf("invalid local port: %d", r.LocalPort)
+	}
+	if r.RemoteService == "" && (r.RemotePort < 1 || r.RemotePort > 65535) {
+		return fmt.Errorf("invalid remote port: %d", r.RemotePort)
+	}
+	return nil
+}
+
+// A Service is a named address that routes can use instead of a port, so the
+// peers connecting to it don't need to know where it is.
+type Service struct {
+	Name string
+	// Address is the host and port connected to
+	Address string
+	Type    RouteType
+}
+
+// A RetiredKeyPair is a key pair that has been rotated out. It is still used to
+// accept connections from Peers until it expires.
+type RetiredKeyPair struct {
+	KeyPair crypt.KeyPair
+	Peers   []crypt.Key `json:",omitempty"`
+	Expires time.Time
+}
+
+// A PeerConfig overrides settings for a single peer.
+type PeerConfig struct {
+	Peer crypt.Key
+	// ICEServers replace the ICE servers used to connect to the peer
+	ICEServers []peer.ICEServer `json:"iceservers,omitempty"`
+	// PostQuantumKey is the peer's post-quantum key, exchanged when pairing or
+	// imported with key import --peer. With it, every signal message sent to
+	// the peer uses hybrid encryption, including the first.
+	PostQuantumKey crypt.PostQuantumKey `json:"postquantumkey,omitempty"`
 }
 
 // A Config is the configuration for the RTCTunnel.
 type Config struct {
-	KeyPair       crypt.KeyPair
+	KeyPair crypt.KeyPair
+	// KeySource is where to load the private key from instead of KeyPair, see
+	// crypt.LoadKeyPair
+	KeySource     string  `json:"keysource,omitempty"`
 	Routes        []Route `json:",omitempty"`
 	SignalChannel string  `json:"signalchannel,omitempty"`
+	// RetiredKeyPairs are previous key pairs that are still valid
+	RetiredKeyPairs []RetiredKeyPair `json:"retiredkeypairs,omitempty"`
+	// AcceptKeyRotation allows peers to update routes when they rotate their keys
+	AcceptKeyRotation bool `json:"acceptkeyrotation,omitempty"`
+	// IdentityKeyPair signs the device list, it's only needed on the device
+	// which manages the identity
+	IdentityKeyPair *crypt.IdentityKeyPair `json:"identitykeypair,omitempty"`
+	// Identity is the device list of the identity this device belongs to
+	Identity *crypt.DeviceList `json:"identity,omitempty"`
+	// Identities are the device lists of peers with multiple devices
+	Identities []crypt.DeviceList `json:"identities,omitempty"`
+	// ICEServers are the STUN and TURN servers used to connect to peers. If
+	// empty peer.DefaultICEServers are used
+	ICEServers []peer.ICEServer `json:"iceservers,omitempty"`
+	// PeerConfigs override settings for individual peers
+	PeerConfigs []PeerConfig `json:"peerconfigs,omitempty"`
+	// Multiplex multiplexes connections over a single data channel per peer,
+	// if the peer enables it too
+	Multiplex bool `json:"multiplex,omitempty"`
+	// Services are the named services peers can open routes to
+	Services []Service `json:"services,omitempty"`
 }
 
 // LoadConfig loads the config off of the disk.
@@ -60,19 +151,48 @@ func LoadConfig(path string) (*Config, error) {
 		}
 	}
 
+	if cfg.KeySource != "" {
+		keypair, err := crypt.LoadKeyPair(cfg.KeySource)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.KeyPair.Public.Valid() && cfg.KeyPair.Public != keypair.Public {
+			return nil, fmt.Errorf("the key from %s does not match the public key in the config", cfg.KeySource)
+		}
+		// the post-quantum key pair is always stored in the config
+		keypair.PostQuantum = cfg.KeyPair.PostQuantum
+		cfg.KeyPair = keypair
+	}
+
 	return &cfg, nil
 }
 
 // AddRoute adds a route to the config. It also validates the route and removes duplicates.
 func (cfg *Config) AddRoute(localPort int, localPeer, remotePeer crypt.Key, remotePort int, routeType RouteType) error {
-	nr := Route{
+	return cfg.addRoute(Route{
 		LocalPort:  localPort,
 		LocalPeer:  localPeer,
 		RemotePeer: remotePeer,
 		RemotePort: remotePort,
 		Type:       routeType,
-	}
+	})
+}
+
+// AddServiceRoute adds a route to a named service on the remote peer.
+func (cfg *Config) AddServiceRoute(localPort int, localPeer, remotePeer crypt.Key, service string, routeType RouteType) error {
+	return cfg.addRoute(Route{
+		LocalPort:     localPort,
+		LocalPeer:     localPeer,
+		RemotePeer:    remotePeer,
+		RemoteService: service,
+		Type:          routeType,
+	})
+}
 
+func (cfg *Config) addRoute(nr Route) error {
+	if err := nr.Validate(); err != nil {
+		return err
+	}
 	for _, r := range cfg.Routes {
 		if nr == r {
 			return nil
@@ -82,15 +202,221 @@ func (cfg *Config) AddRoute(localPort int, localPeer, remotePeer crypt.Key, remo
 	return nil
 }
 
+// AddService adds a named service, replacing any service with the same name.
+func (cfg *Config) AddService(name, address string, routeType RouteType) error {
+	if name == "" {
+		return fmt.Errorf("a service name is required")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("invalid service address: %w", err)
+	}
+
+	ns := Service{Name: name, Address: address, Type: routeType}
+	for i := range cfg.Services {
+		if cfg.Services[i].Name == name {
+			cfg.Services[i] = ns
+			return nil
+		}
+	}
+	cfg.Services = append(cfg.Services, ns)
+	return nil
+}
+
+// Service returns the service with the given name, or nil.
+func (cfg *Config) Service(name string) *Service {
+	for i := range cfg.Services {
+		if cfg.Services[i].Name == name {
+			return &cfg.Services[i]
+		}
+	}
+	return nil
+}
+
+// IsSelf returns true if the key is this device's public key, or the identity
+// this device belongs to.
+func (cfg *Config) IsSelf(key crypt.Key) bool {
+	if key == cfg.KeyPair.Public {
+		return true
+	}
+	return cfg.Identity != nil && cfg.Identity.Identity == key && cfg.Identity.Contains(cfg.KeyPair.Public)
+}
+
+// DeviceList returns the device list for a peer identity, or nil if the peer
+// is a single device.
+func (cfg *Config) DeviceList(identity crypt.Key) *crypt.DeviceList {
+	for i := range cfg.Identities {
+		if cfg.Identities[i].Identity == identity {
+			return &cfg.Identities[i]
+		}
+	}
+	return nil
+}
+
+// AddDeviceList adds or replaces a device list. The list must be signed by its
+// identity and must not be older than the existing list.
+func (cfg *Config) AddDeviceList(list crypt.DeviceList) error {
+	err := list.Verify()
+	if err != nil {
+		return err
+	}
+
+	if list.Contains(cfg.KeyPair.Public) {
+		if cfg.Identity != nil && cfg.Identity.Identity == list.Identity && cfg.Identity.Version > list.Version {
+			return fmt.Errorf("device list version %d is older than the current version %d", list.Version, cfg.Identity.Version)
+		}
+		cfg.Identity = &list
+		return nil
+	} else if cfg.Identity != nil && cfg.Identity.Identity == list.Identity {
+		if cfg.Identity.Version > list.Version {
+			return fmt.Errorf("device list version %d is older than the current version %d", list.Version, cfg.Identity.Version)
+		}
+		// this device was removed from the identity
+		cfg.Identity = nil
+	}
+
+	if existing := cfg.DeviceList(list.Identity); existing != nil {
+		if existing.Version > list.Version {
+			return fmt.Errorf("device list version %d is older than the current version %d", list.Version, existing.Version)
+		}
+		*existing = list
+		return nil
+	}
+	cfg.Identities = append(cfg.Identities, list)
+	return nil
+}
+
+// ICEServersFor returns the ICE servers used to connect to a peer.
+func (cfg *Config) ICEServersFor(peerPublicKey crypt.Key) []peer.ICEServer {
+	for _, pc := range cfg.PeerConfigs {
+		if pc.Peer == peerPublicKey && len(pc.ICEServers) > 0 {
+			return pc.ICEServers
+		}
+	}
+	return cfg.ICEServers
+}
+
+// SetPeerPostQuantumKey stores a peer's post-quantum key.
+func (cfg *Config) SetPeerPostQuantumKey(peerPublicKey crypt.Key, key crypt.PostQuantumKey) {
+	for i := range cfg.PeerConfigs {
+		if cfg.PeerConfigs[i].Peer == peerPublicKey {
+			cfg.PeerConfigs[i].PostQuantumKey = key
+			return
+		}
+	}
+	cfg.PeerConfigs = append(cfg.PeerConfigs, PeerConfig{Peer: peerPublicKey, PostQuantumKey: key})
+}
+
+// Peers returns the distinct public keys of the peers referenced by routes.
+func (cfg *Config) Peers() []crypt.Key {
+	var peers []crypt.Key
+	seen := map[crypt.Key]bool{}
+	for _, r := range cfg.Routes {
+		var peerPublicKey crypt.Key
+		if cfg.IsSelf(r.LocalPeer) {
+			peerPublicKey = r.RemotePeer
+		} else if cfg.IsSelf(r.RemotePeer) {
+			peerPublicKey = r.LocalPeer
+		}
+		if !peerPublicKey.Valid() || seen[peerPublicKey] {
+			continue
+		}
+		seen[peerPublicKey] = true
+		peers = append(peers, peerPublicKey)
+	}
+	return peers
+}
+
+// RotateKeyPair replaces the key pair with next. The previous key pair is retired
+// and remains valid until expires. Routes are updated to use the new key.
+func (cfg *Config) RotateKeyPair(next crypt.KeyPair, expires time.Time) {
+	prev := cfg.KeyPair
+	cfg.RetiredKeyPairs = append(cfg.RetiredKeyPairs, RetiredKeyPair{
+		KeyPair: prev,
+		Peers:   cfg.Peers(),
+		Expires: expires,
+	})
+	cfg.KeyPair = next
+	cfg.replaceKey(prev.Public, next.Public)
+}
+
+// ApplyRotation updates routes to use a peer's new key. It returns false if no
+// routes referenced the peer's old key.
+func (cfg *Config) ApplyRotation(rotation crypt.Rotation) bool {
+	if rotation.Old == cfg.KeyPair.Public {
+		return false
+	}
+	if !cfg.replaceKey(rotation.Old, rotation.New) {
+		return false
+	}
+	if len(rotation.PostQuantumKey) > 0 {
+		cfg.SetPeerPostQuantumKey(rotation.New, rotation.PostQuantumKey)
+	}
+	return true
+}
+
+// PruneRetiredKeyPairs removes any retired key pairs which have expired.
+func (cfg *Config) PruneRetiredKeyPairs(now time.Time) {
+	var retired []RetiredKeyPair
+	for _, rkp := range cfg.RetiredKeyPairs {
+		if now.Before(rkp.Expires) {
+			retired = append(retired, rkp)
+		}
+	}
+	cfg.RetiredKeyPairs = retired
+}
+
+func (cfg *Config) replaceKey(old, new crypt.Key) bool {
+	replaced := false
+	routes := cfg.Routes
+	cfg.Routes = nil
+	for _, r := range routes {
+		if r.LocalPeer == old {
+			r.LocalPeer = new
+			replaced = true
+		}
+		if r.RemotePeer == old {
+			r.RemotePeer = new
+			replaced = true
+		}
+		_ = cfg.addRoute(r)
+	}
+	for i := range cfg.PeerConfigs {
+		if cfg.PeerConfigs[i].Peer == old {
+			cfg.PeerConfigs[i].Peer = new
+			// the new key pair has its own post-quantum key. Sending with
+			// the old one would make every signal message fail to decrypt,
+			// so fall back to learning it from the peer's first message
+			cfg.PeerConfigs[i].PostQuantumKey = nil
+		}
+	}
+	return replaced
+}
+
+// ensurePostQuantumKey generates a post-quantum key pair for configs created
+// before it was stored, and saves it so peers keep seeing the same key.
+func (cfg *Config) ensurePostQuantumKey(path string) error {
+	if cfg.KeyPair.PostQuantum != nil || !cfg.KeyPair.Private.Valid() {
+		return nil
+	}
+	cfg.KeyPair.PostQuantum = crypt.GeneratePostQuantumKeyPair()
+	return cfg.Save(path)
+}
+
 // Save saves the config file
 func (cfg *Config) Save(path string) error {
+	saved := *cfg
+	if saved.KeySource != "" {
+		// the private key is stored externally
+		saved.KeyPair.Private = crypt.Key{}
+	}
+
 	var bs []byte
 	var err error
 	switch filepath.Ext(path) {
 	case ".json":
-		bs, err = json.Marshal(cfg)
+		bs, err = json.Marshal(saved)
 	default:
-		bs, err = yaml.Marshal(cfg)
+		bs, err = yaml.Marshal(saved)
 	}
 	if err != nil {
 		return err
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateKeyPairServiceRoute(t *testing.T) {
+	local := crypt.GenerateKeyPair()
+	remote := crypt.GenerateKeyPair()
+
+	cfg := &Config{KeyPair: local}
+	assert.NoError(t, cfg.AddServiceRoute(2222, local.Public, remote.Public, "ssh", RouteTypeTCP))
+
+	next := crypt.GenerateKeyPair()
+	cfg.RotateKeyPair(next, time.Now().Add(time.Hour))
+	assert.Equal(t, []Route{{
+		LocalPort:     2222,
+		LocalPeer:     next.Public,
+		RemotePeer:    remote.Public,
+		RemoteService: "ssh",
+		Type:          RouteTypeTCP,
+	}}, cfg.Routes)
+
+	rotated := crypt.GenerateKeyPair()
+	assert.True(t, cfg.ApplyRotation(crypt.Rotation{Old: remote.Public, New: rotated.Public}))
+	assert.Equal(t, "ssh", cfg.Routes[0].RemoteService)
+	assert.Equal(t, rotated.Public, cfg.Routes[0].RemotePeer)
+}
+
+func TestRouteValidate(t *testing.T) {
+	assert.NoError(t, Route{LocalPort: 22, RemotePort: 22, Type: RouteTypeTCP}.Validate())
+	assert.NoError(t, Route{LocalPort: 2222, RemoteService: "ssh", Type: RouteTypeTCP}.Validate())
+	assert.Error(t, Route{LocalPort: 22, RemotePort: 22, Type: "SCTP"}.Validate())
+	assert.Error(t, Route{LocalPort: 0, RemotePort: 22, Type: RouteTypeTCP}.Validate())
+	assert.Error(t, Route{LocalPort: 22, RemotePort: 70000, Type: RouteTypeUDP}.Validate())
+
+	cfg := &Config{}
+	assert.Error(t, cfg.AddRoute(22, crypt.Key{}, crypt.Key{}, 22, "SCTP"))
+	assert.Empty(t, cfg.Routes)
+}
+
+func TestPeerPostQuantumKey(t *testing.T) {
+	local := crypt.GenerateKeyPair()
+	remote := crypt.GenerateKeyPair()
+
+	cfg := &Config{KeyPair: local}
+	assert.NoError(t, cfg.AddRoute(2222, local.Public, remote.Public, 22, RouteTypeTCP))
+	cfg.SetPeerPostQuantumKey(remote.Public, remote.PostQuantumKey())
+
+	for _, name := range []string{"config.yaml", "config.json"} {
+		path := filepath.Join(t.TempDir(), name)
+		assert.NoError(t, cfg.Save(path))
+		loaded, err := LoadConfig(path)
+		assert.NoError(t, err)
+		if assert.Len(t, loaded.PeerConfigs, 1, name) {
+			assert.Equal(t, remote.Public, loaded.PeerConfigs[0].Peer, name)
+			assert.True(t, bytes.Equal(remote.PostQuantumKey(), loaded.PeerConfigs[0].PostQuantumKey), name)
+		}
+	}
+
+	// the peer's new key pair has its own post-quantum key
+	rotated := crypt.GenerateKeyPair()
+	rotation := crypt.NewRotation(remote, rotated, local.Public, time.Now().Add(time.Hour))
+	assert.True(t, cfg.ApplyRotation(rotation))
+	assert.Equal(t, []PeerConfig{{Peer: rotated.Public, PostQuantumKey: rotated.PostQuantumKey()}}, cfg.PeerConfigs)
+
+	// without one in the rotation, the stale key is dropped
+	next := crypt.GenerateKeyPair()
+	assert.True(t, cfg.ApplyRotation(crypt.Rotation{Old: rotated.Public, New: next.Public}))
+	assert.Equal(t, []PeerConfig{{Peer: next.Public}}, cfg.PeerConfigs)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/peer"
+)
+
+const (
+	// udpFlowIdleTimeout is how long a UDP flow is kept without any packets in
+	// either direction.
+	udpFlowIdleTimeout = 2 * time.Minute
+	// udpFlowQueueSize is how many packets from a local client are queued
+	// while they're sent to the peer. Any more are dropped.
+	udpFlowQueueSize = 64
+	// maxUDPPacketSize is the largest UDP payload.
+	maxUDPPacketSize = 65535
+)
+
+// A udpFlow is the packets exchanged between one UDP client and the peer. It's
+// closed once it has been idle for udpFlowIdleTimeout.
+type udpFlow struct {
+	lastActive atomic.Int64
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+func newUDPFlow() *udpFlow {
+	f := &udpFlow{done: make(chan struct{})}
+	f.touch()
+	return f
+}
+
+// touch marks the flow as active.
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+	})
+}
+
+// expire closes the flow once it's idle. It returns when the flow is closed.
+func (f *udpFlow) expire() {
+	for {
+		idle := time.Since(time.Unix(0, f.lastActive.Load()))
+		if idle >= udpFlowIdleTimeout {
+			f.close()
+			return
+		}
+		select {
+		case <-time.After(udpFlowIdleTimeout - idle):
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// A udpNAT forwards the packets received by a local UDP socket to the peer.
+// Each client gets its own flow, so replies are sent back to the client they're
+// for, and the peer can tell clients apart.
+type udpNAT struct {
+	local *net.UDPConn
+	open  func() (net.PacketConn, error)
+
+	mu    sync.Mutex
+	flows map[string]chan []byte
+}
+
+func localUDPListener(pc *peer.Conn, route Route) {
+	local, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP:   net.ParseIP(options.bindAddress),
+		Port: route.LocalPort,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("error listening for UDP packets")
+	}
+	defer local.Close()
+
+	nat := &udpNAT{
+		local: local,
+		open: func() (net.PacketConn, error) {
+			if route.RemoteService != "" {
+				return pc.OpenPacketTarget(route.Target())
+			}
+			return pc.OpenPacket(route.RemotePort)
+		},
+		flows: map[string]chan []byte{},
+	}
+	nat.run()
+}
+
+// run reads packets from the local socket and queues them on their client's
+// flow.
+func (nat *udpNAT) run() {
+	buf := make([]byte, maxUDPPacketSize)
+	for {
+		n, src, err := nat.local.ReadFromUDP(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				time.Sleep(time.Second)
+				continue
+			}
+			log.Fatal().Err(err).Msg("error reading UDP packet")
+		}
+
+		nat.mu.Lock()
+		packets, ok := nat.flows[src.String()]
+		if !ok {
+			packets = make(chan []byte, udpFlowQueueSize)
+			nat.flows[src.String()] = packets
+			go nat.relay(src, packets)
+		}
+		nat.mu.Unlock()
+
+		select {
+		case packets <- append([]byte(nil), buf[:n]...):
+		default:
+			log.Debug().Stringer("source", src).Msg("dropped UDP packet, flow queue is full")
+		}
+	}
+}
+
+// relay opens a flow to the peer for a client and relays packets in both
+// directions until the flow is closed.
+func (nat *udpNAT) relay(src *net.UDPAddr, packets <-chan []byte) {
+	defer func() {
+		nat.mu.Lock()
+		delete(nat.flows, src.String())
+		nat.mu.Unlock()
+	}()
+
+	remote, err := nat.open()
+	if err != nil {
+		log.Warn().Err(err).Stringer("source", src).Msg("failed to open UDP flow")
+		return
+	}
+	defer remote.Close()
+
+	log.Debug().Stringer("source", src).Msg("opened UDP flow")
+	defer log.Debug().Stringer("source", src).Msg("closed UDP flow")
+
+	flow := newUDPFlow()
+	go func() {
+		defer flow.close()
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, _, err := remote.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			flow.touch()
+			if _, err := nat.local.WriteToUDP(buf[:n], src); err != nil {
+				log.Debug().Err(err).Stringer("source", src).Msg("failed to write UDP packet")
+			}
+		}
+	}()
+	go func() {
+		defer flow.close()
+		for {
+			var packet []byte
+			select {
+			case packet = <-packets:
+			case <-flow.done:
+				return
+			}
+			flow.touch()
+			if _, err := remote.WriteTo(packet, nil); errors.Is(err, peer.ErrMessageTooLong) {
+				log.Debug().Int("size", len(packet)).Stringer("source", src).Msg("dropped UDP packet, too large")
+			} else if err != nil {
+				return
+			}
+		}
+	}()
+	flow.expire()
+}
+
+// acceptRemotePackets accepts the UDP flows opened by a peer.
+func acceptRemotePackets(cfg *Config, pc *peer.Conn) {
+	for {
+		remote, target, err := pc.AcceptPacketTarget()
+		if err != nil {
+			select {
+			case <-pc.Done():
+				return
+			default:
+			}
+			log.Error().Err(err).Msg("failed to accept remote UDP flow")
+			continue
+		}
+
+		target.Protocol = peer.ProtocolUDP
+		route := remoteRoute(cfg, target)
+		if route == nil {
+			log.Warn().Stringer("target", target).Msg("remote peer attempted to send packets to disallowed target")
+			remote.Close()
+			continue
+		}
+		address, err := routeAddress(cfg, *route)
+		if err != nil {
+			log.Warn().Err(err).Stringer("target", target).Msg("failed to resolve route")
+			remote.Close()
+			continue
+		}
+
+		go acceptRemoteUDPFlow(address, remote)
+	}
+}
+
+// acceptRemoteUDPFlow relays the packets of a flow through its own local UDP
+// socket, so replies only go back to the client that sent them.
+func acceptRemoteUDPFlow(address string, remote net.PacketConn) {
+	defer remote.Close()
+
+	local, err := net.Dial("udp", address)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to establish connection to local port")
+		return
+	}
+	defer local.Close()
+
+	flow := newUDPFlow()
+	go func() {
+		defer flow.close()
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, _, err := remote.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			flow.touch()
+			if _, err := local.Write(buf[:n]); err != nil {
+				log.Debug().Err(err).Str("address", address).Msg("failed to write UDP packet")
+			}
+		}
+	}()
+	go func() {
+		defer flow.close()
+		buf := make([]byte, maxUDPPacketSize)
+		for {
+			n, err := local.Read(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
+				// eg. connection refused, if nothing is listening yet
+				continue
+			}
+			flow.touch()
+			if _, err := remote.WriteTo(buf[:n], nil); errors.Is(err, peer.ErrMessageTooLong) {
+				log.Debug().Int("size", n).Str("address", address).Msg("dropped UDP packet, too large")
+			} else if err != nil {
+				return
+			}
+		}
+	}()
+	flow.expire()
+}
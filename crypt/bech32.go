@@ -0,0 +1,186 @@
+package crypt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// The checksummed key format is bech32 (BIP-173) with the human readable part
+// "rtc", followed by a version and the key. Keys in this format start with
+// "rtc1" and a single mistyped character is always detected.
+const (
+	bech32HRP     = "rtc"
+	bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	// bech32Version is the current version of the checksummed key format
+	bech32Version = 0
+	// bech32KeyLength is the length of a checksummed key: the "rtc1" prefix,
+	// the version, 52 characters for the key and a 6 character checksum
+	bech32KeyLength = len(bech32HRP) + 1 + 1 + 52 + 6
+)
+
+// A KeyTypoError is returned when a checksummed key has a typo.
+type KeyTypoError struct {
+	// Position is the index of the likely typo, or -1 if it is unknown
+	Position int
+	// Suggestion is the likely correct character
+	Suggestion byte
+}
+
+func (err *KeyTypoError) Error() string {
+	if err.Position < 0 {
+		return "invalid key: checksum mismatch"
+	}
+	return fmt.Sprintf("invalid key: checksum mismatch, possible typo at position %d (did you mean %q?)",
+		err.Position+1, err.Suggestion)
+}
+
+// Checksummed returns the key in the checksummed "rtc1..." format.
+func (key Key) Checksummed() string {
+	data := append([]byte{bech32Version}, convertBits(key[:], 8, 5, true)...)
+	data = append(data, bech32Checksum(bech32HRP, data)...)
+
+	var sb strings.Builder
+	sb.WriteString(bech32HRP)
+	sb.WriteByte('1')
+	for _, b := range data {
+		sb.WriteByte(bech32Charset[b])
+	}
+	return sb.String()
+}
+
+// isChecksummed returns true if the string looks like a checksummed key. Base58
+// keys can start with "rtc1" too, but are never as long.
+func isChecksummed(str string) bool {
+	return len(str) == bech32KeyLength && hasChecksummedPrefix(str)
+}
+
+func hasChecksummedPrefix(str string) bool {
+	return strings.HasPrefix(strings.ToLower(str), bech32HRP+"1")
+}
+
+func decodeChecksummed(str string) (key Key, err error) {
+	if strings.ToLower(str) != str && strings.ToUpper(str) != str {
+		return key, errors.New("invalid key: mixed case")
+	}
+	str = strings.ToLower(str)
+
+	payload := str[len(bech32HRP)+1:]
+	data := make([]byte, len(payload))
+	for i := 0; i < len(payload); i++ {
+		idx := strings.IndexByte(bech32Charset, payload[i])
+		if idx < 0 {
+			return key, fmt.Errorf("invalid key: invalid character %q at position %d", payload[i], len(bech32HRP)+2+i)
+		}
+		data[i] = byte(idx)
+	}
+	if len(data) < 7 {
+		return key, errors.New("invalid key: too short")
+	}
+
+	if bech32Polymod(bech32HRP, data) != 1 {
+		return key, findTypo(data)
+	}
+
+	data = data[:len(data)-6]
+	if data[0] != bech32Version {
+		return key, fmt.Errorf("invalid key: unsupported version %d", data[0])
+	}
+	bs, err := convertBitsStrict(data[1:])
+	if err != nil {
+		return key, err
+	}
+	if len(bs) != KeySize {
+		return key, errors.New("invalid key")
+	}
+	copy(key[:], bs)
+	return key, nil
+}
+
+// findTypo looks for a single character substitution that fixes the checksum.
+func findTypo(data []byte) error {
+	fixed := make([]byte, len(data))
+	var found *KeyTypoError
+	for i := range data {
+		for c := byte(0); c < 32; c++ {
+			if c == data[i] {
+				continue
+			}
+			copy(fixed, data)
+			fixed[i] = c
+			if bech32Polymod(bech32HRP, fixed) == 1 {
+				if found != nil {
+					// ambiguous
+					return &KeyTypoError{Position: -1}
+				}
+				found = &KeyTypoError{Position: len(bech32HRP) + 1 + i, Suggestion: bech32Charset[c]}
+			}
+		}
+	}
+	if found == nil {
+		return &KeyTypoError{Position: -1}
+	}
+	return found
+}
+
+func bech32Polymod(hrp string, data []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	step := func(v byte) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	for i := 0; i < len(hrp); i++ {
+		step(hrp[i] >> 5)
+	}
+	step(0)
+	for i := 0; i < len(hrp); i++ {
+		step(hrp[i] & 31)
+	}
+	for _, v := range data {
+		step(v)
+	}
+	return chk
+}
+
+func bech32Checksum(hrp string, data []byte) []byte {
+	values := append(append([]byte{}, data...), 0, 0, 0, 0, 0, 0)
+	mod := bech32Polymod(hrp, values) ^ 1
+	checksum := make([]byte, 6)
+	for i := range checksum {
+		checksum[i] = byte((mod >> uint(5*(5-i))) & 31)
+	}
+	return checksum
+}
+
+func convertBits(data []byte, from, to uint, pad bool) []byte {
+	var acc, bits uint
+	var out []byte
+	maxv := uint(1)<<to - 1
+	for _, v := range data {
+		acc = acc<<from | uint(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte((acc>>bits)&maxv))
+		}
+	}
+	if pad && bits > 0 {
+		out = append(out, byte((acc<<(to-bits))&maxv))
+	}
+	return out
+}
+
+func convertBitsStrict(data []byte) ([]byte, error) {
+	out := convertBits(data, 5, 8, false)
+	// the leftover padding bits must be zero
+	if bits := uint(len(data)*5) % 8; bits > 0 && data[len(data)-1]&(1<<bits-1) != 0 {
+		return nil, errors.New("invalid key: invalid padding")
+	}
+	return out, nil
+}
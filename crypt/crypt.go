@@ -23,14 +23,27 @@ type (
 	// A KeyPair is a public, private key pair
 	KeyPair struct {
 		Public, Private Key
+		// PostQuantum is the ML-KEM-768 key pair used for hybrid encryption.
+		// It's generated independently of Private, so breaking X25519 doesn't
+		// reveal it.
+		PostQuantum *PostQuantumKeyPair `json:",omitempty" yaml:",omitempty"`
 	}
 	// Nonce is a number used once
 	Nonce = [NonceSize]byte
 )
 
-// NewKey creates a new key from a base58 string
+// NewKey creates a new key from a base58 string or a checksummed "rtc1..."
+// string
 func NewKey(str string) (key Key, err error) {
+	if isChecksummed(str) {
+		return decodeChecksummed(str)
+	}
 	bs, err := base58.Decode(str)
+	if (err != nil || len(bs) != KeySize) && hasChecksummedPrefix(str) {
+		// most likely a checksummed key with characters missing or added,
+		// which gets a more helpful error
+		return decodeChecksummed(str)
+	}
 	if err != nil {
 		return key, err
 	}
@@ -50,7 +63,7 @@ func (key Key) String() string {
 }
 
 func (key Key) MarshalJSON() ([]byte, error) {
-	bs, err := json.Marshal(key.String())
+	bs, err := json.Marshal(key.marshalText())
 	if err != nil {
 		return nil, err
 	}
@@ -63,7 +76,7 @@ func (key *Key) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	*key, err = NewKey(raw)
+	*key, err = unmarshalText(raw)
 	if err != nil {
 		return err
 	}
@@ -71,7 +84,7 @@ func (key *Key) UnmarshalJSON(data []byte) error {
 }
 
 func (key Key) MarshalYAML() (interface{}, error) {
-	return key.String(), nil
+	return key.marshalText(), nil
 }
 
 func (key *Key) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -80,20 +93,36 @@ func (key *Key) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err != nil {
 		return err
 	}
-	*key, err = NewKey(str)
+	*key, err = unmarshalText(str)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// marshalText returns the text used to store a key. Missing keys are stored as
+// an empty string.
+func (key Key) marshalText() string {
+	if !key.Valid() {
+		return ""
+	}
+	return key.String()
+}
+
+func unmarshalText(str string) (Key, error) {
+	if str == "" {
+		return Key{}, nil
+	}
+	return NewKey(str)
+}
+
 // GenerateKeyPair generates a (public, private) encryption key
 func GenerateKeyPair() KeyPair {
 	pub, priv, err := box.GenerateKey(rand.Reader)
 	if err != nil {
 		panic(err)
 	}
-	return KeyPair{Public: *pub, Private: *priv}
+	return KeyPair{Public: *pub, Private: *priv, PostQuantum: GeneratePostQuantumKeyPair()}
 }
 
 // Encrypt encrypts a message using a peer's public key and the local private key
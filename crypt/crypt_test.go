@@ -1,9 +1,16 @@
 package crypt
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/nacl/box"
+	"gopkg.in/yaml.v2"
 )
 
 func Test(t *testing.T) {
@@ -17,3 +24,409 @@ func Test(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, msg, decrypted)
 }
+
+func TestRotation(t *testing.T) {
+	old := GenerateKeyPair()
+	new := GenerateKeyPair()
+	peer := GenerateKeyPair()
+
+	r := NewRotation(old, new, peer.Public, time.Now().Add(time.Hour))
+	assert.NoError(t, r.Verify(peer))
+	assert.Equal(t, new.PostQuantumKey(), r.PostQuantumKey)
+
+	other := GenerateKeyPair()
+	assert.Error(t, r.Verify(other), "should only verify for the addressed peer")
+
+	forged := r
+	forged.New = other.Public
+	assert.Error(t, forged.Verify(peer), "should not verify without the new private key")
+
+	extended := r
+	extended.Expires = r.Expires.Add(time.Hour)
+	assert.Error(t, extended.Verify(peer), "should not verify a modified expiry")
+
+	invalid := r
+	invalid.PostQuantumKey = PostQuantumKey("short")
+	assert.Error(t, invalid.Verify(peer))
+}
+
+func TestPAKE(t *testing.T) {
+	a := NewPAKE(PAKERoleA, []byte("7-purple-sausage"))
+	b := NewPAKE(PAKERoleB, []byte("7-purple-sausage"))
+	assert.NoError(t, a.Finish(b.Message()))
+	assert.NoError(t, b.Finish(a.Message()))
+	assert.NoError(t, a.VerifyConfirmation(b.Confirmation()))
+	assert.NoError(t, b.VerifyConfirmation(a.Confirmation()))
+
+	msg := []byte("Hello World")
+	opened, err := b.Open(a.Seal(msg))
+	assert.NoError(t, err)
+	assert.Equal(t, msg, opened)
+
+	c := NewPAKE(PAKERoleA, []byte("7-purple-sausage"))
+	d := NewPAKE(PAKERoleB, []byte("7-purple-sandwich"))
+	assert.NoError(t, c.Finish(d.Message()))
+	assert.NoError(t, d.Finish(c.Message()))
+	assert.Error(t, c.VerifyConfirmation(d.Confirmation()))
+	assert.Error(t, d.VerifyConfirmation(c.Confirmation()))
+	_, err = d.Open(c.Seal(msg))
+	assert.Error(t, err)
+}
+
+func TestEncoding(t *testing.T) {
+	pair := GenerateKeyPair()
+	// encoded keys don't include the post-quantum key pair
+	pair.PostQuantum = nil
+
+	for _, enc := range Encodings {
+		str, err := pair.Private.Encode(enc, true)
+		assert.NoError(t, err)
+
+		decoded, err := DecodeKeyPair(enc, str)
+		assert.NoError(t, err, enc)
+		assert.Equal(t, pair, decoded, enc)
+
+		detected, err := DecodeKeyPair("", str)
+		assert.NoError(t, err, enc)
+		assert.Equal(t, pair, detected, enc)
+
+		str, err = pair.Public.Encode(enc, false)
+		assert.NoError(t, err)
+		public, err := DecodeKey("", str)
+		assert.NoError(t, err, enc)
+		assert.Equal(t, pair.Public, public, enc)
+	}
+
+	str, err := pair.Public.Encode(EncodingPEM, false)
+	assert.NoError(t, err)
+	_, err = DecodeKeyPair("", str)
+	assert.Error(t, err, "should not accept a public key as a private key")
+}
+
+func TestLoadKeyPair(t *testing.T) {
+	pair := GenerateKeyPair()
+	// encoded keys don't include the post-quantum key pair
+	pair.PostQuantum = nil
+	str, err := pair.Private.Encode(EncodingPEM, true)
+	assert.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.NoError(t, os.WriteFile(path, []byte(str), 0600))
+	loaded, err := LoadKeyPair("file:" + path)
+	assert.NoError(t, err)
+	assert.Equal(t, pair, loaded)
+
+	t.Setenv("RTCTUNNEL_TEST_KEY", pair.Private.String())
+	loaded, err = LoadKeyPair("env:RTCTUNNEL_TEST_KEY")
+	assert.NoError(t, err)
+	assert.Equal(t, pair, loaded)
+
+	_, err = LoadKeyPair("env:RTCTUNNEL_TEST_MISSING_KEY")
+	assert.Error(t, err)
+	_, err = LoadKeyPair("vault:secret")
+	assert.Error(t, err)
+}
+
+func TestMissingKeyJSON(t *testing.T) {
+	bs, err := json.Marshal(KeyPair{})
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Public":"","Private":""}`, string(bs))
+
+	var pair KeyPair
+	assert.NoError(t, json.Unmarshal(bs, &pair))
+	assert.False(t, pair.Private.Valid())
+}
+
+func TestChecksummedKey(t *testing.T) {
+	pair := GenerateKeyPair()
+	str := pair.Public.Checksummed()
+	assert.True(t, strings.HasPrefix(str, "rtc1"))
+
+	key, err := NewKey(str)
+	assert.NoError(t, err)
+	assert.Equal(t, pair.Public, key)
+
+	key, err = NewKey(strings.ToUpper(str))
+	assert.NoError(t, err)
+	assert.Equal(t, pair.Public, key)
+
+	// legacy keys still work
+	key, err = NewKey(pair.Public.String())
+	assert.NoError(t, err)
+	assert.Equal(t, pair.Public, key)
+
+	// a single typo is detected and located
+	bs := []byte(str)
+	pos := 20
+	original := bs[pos]
+	if bs[pos] == 'q' {
+		bs[pos] = 'p'
+	} else {
+		bs[pos] = 'q'
+	}
+	_, err = NewKey(string(bs))
+	var typo *KeyTypoError
+	if assert.ErrorAs(t, err, &typo) {
+		assert.Equal(t, pos, typo.Position)
+		assert.Equal(t, original, typo.Suggestion)
+	}
+
+	_, err = NewKey(str[:10] + "b" + str[11:])
+	assert.ErrorContains(t, err, "invalid character")
+
+	_, err = NewKey(str[:len(str)-1])
+	assert.ErrorContains(t, err, "checksum")
+
+	// base58 keys can start with "rtc1" too
+	legacy := "rtc1" + strings.Repeat("2", 39)
+	key, err = NewKey(legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, key.String())
+	key, err = DecodeKey("", legacy)
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, key.String())
+}
+
+func TestChecksummedKeyVector(t *testing.T) {
+	var key Key
+	for i := range key {
+		key[i] = byte(i)
+	}
+	assert.Equal(t, "rtc1qqqqsyqcyq5rqwzqfpg9scrgwpugpzysnzs23v9ccrydpk8qarc0ssx5flz", key.Checksummed())
+}
+
+func TestMnemonic(t *testing.T) {
+	pair := GenerateKeyPair()
+	mnemonic, err := pair.Mnemonic()
+	assert.NoError(t, err)
+	assert.Len(t, strings.Fields(mnemonic), 24)
+
+	recovered, err := KeyPairFromMnemonic("  " + strings.ToUpper(mnemonic) + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, pair.Public, recovered.Public)
+	assert.Equal(t, pair.Private, recovered.Private)
+
+	words := strings.Fields(mnemonic)
+	words[0], words[1] = words[1], words[0]
+	if words[0] != words[1] {
+		_, err = KeyPairFromMnemonic(strings.Join(words, " "))
+		assert.Error(t, err)
+	}
+
+	fromSeed, err := KeyPairFromSeed(GenerateSeed())
+	assert.NoError(t, err)
+	assert.True(t, fromSeed.Public.Valid())
+
+	_, err = KeyPairFromSeed([]byte("short"))
+	assert.Error(t, err)
+}
+
+// TestMnemonicVectors makes sure derivation stays stable across releases.
+func TestMnemonicVectors(t *testing.T) {
+	for _, tc := range []struct {
+		mnemonic string
+		public   string
+	}{
+		{
+			mnemonic: "legal winner thank year wave sausage worth useful legal winner thank year " +
+				"wave sausage worth useful legal winner thank year wave sausage worth title",
+			public: "JDxRiZUHEkQdsvMfW3cPDG24hP93AcHmPMhJ8LWSV7E6",
+		},
+		{
+			mnemonic: "letter advice cage absurd amount doctor acoustic avoid letter advice cage absurd " +
+				"amount doctor acoustic avoid letter advice cage absurd amount doctor acoustic bless",
+			public: "EUr3G6oa1YJCDzxGYKdxGJTAm7kvEJ9JJUyVdmvWHCwY",
+		},
+		{
+			mnemonic: "zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo zoo vote",
+			public:   "9vAXcf7JauLX1cZ7G9X25VBVWSor8NWHjZwbEVMHrs2y",
+		},
+	} {
+		pair, err := KeyPairFromMnemonic(tc.mnemonic)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.public, pair.Public.String())
+
+		mnemonic, err := pair.Mnemonic()
+		assert.NoError(t, err)
+		assert.Equal(t, tc.mnemonic, mnemonic)
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	k1 := GenerateKeyPair()
+	k2 := GenerateKeyPair()
+
+	pq := k2.PostQuantumKey()
+	assert.Len(t, pq, PostQuantumKeySize)
+	assert.Equal(t, pq, k2.PostQuantumKey(), "post-quantum keys should be stable")
+	k3 := GenerateKeyPair()
+	assert.NotEqual(t, pq, k3.PostQuantumKey(), "post-quantum keys should be random")
+
+	parsed, err := ParsePostQuantumKey(pq.String())
+	assert.NoError(t, err)
+	assert.Equal(t, pq, parsed)
+	_, err = ParsePostQuantumKey(k2.Public.String())
+	assert.Error(t, err)
+
+	msg := []byte("Hello World")
+	encrypted, err := k1.EncryptHybrid(k2.Public, pq, msg)
+	assert.NoError(t, err)
+	decrypted, err := k2.DecryptHybrid(k1.Public, encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, decrypted)
+
+	_, err = k2.DecryptHybrid(k3.Public, encrypted)
+	assert.Error(t, err, "should be authenticated by the sender's key")
+	_, err = k3.DecryptHybrid(k1.Public, encrypted)
+	assert.Error(t, err, "should only decrypt for the recipient")
+
+	classical := KeyPair{Public: k2.Public, Private: k2.Private}
+	assert.Nil(t, classical.PostQuantumKey())
+	_, err = classical.DecryptHybrid(k1.Public, encrypted)
+	assert.Error(t, err, "should need the post-quantum key")
+}
+
+func TestPostQuantumKeyPair(t *testing.T) {
+	pair := GenerateKeyPair()
+
+	restored, err := NewPostQuantumKeyPair(pair.PostQuantum.Seed())
+	assert.NoError(t, err)
+	assert.Equal(t, pair.PostQuantumKey(), restored.PublicKey())
+	_, err = NewPostQuantumKeyPair([]byte("short"))
+	assert.Error(t, err)
+
+	bs, err := json.Marshal(pair)
+	assert.NoError(t, err)
+	var fromJSON KeyPair
+	assert.NoError(t, json.Unmarshal(bs, &fromJSON))
+	assert.Equal(t, pair.PostQuantumKey(), fromJSON.PostQuantumKey())
+
+	bs, err = yaml.Marshal(pair)
+	assert.NoError(t, err)
+	var fromYAML KeyPair
+	assert.NoError(t, yaml.Unmarshal(bs, &fromYAML))
+	assert.Equal(t, pair.PostQuantumKey(), fromYAML.PostQuantumKey())
+
+	bs, err = json.Marshal(KeyPair{Public: pair.Public, Private: pair.Private})
+	assert.NoError(t, err)
+	assert.NotContains(t, string(bs), "PostQuantum")
+}
+
+func TestSession(t *testing.T) {
+	k1 := GenerateKeyPair()
+	k2 := GenerateKeyPair()
+	s1 := NewSession(k1)
+	s2 := NewSession(k2)
+
+	msg := []byte("Hello World")
+
+	encrypted, err := s1.Encrypt(k2.Public, msg)
+	assert.NoError(t, err)
+	decrypted, err := k2.Decrypt(k1.Public, encrypted)
+	assert.NoError(t, err, "should be compatible with KeyPair.Decrypt")
+	assert.Equal(t, msg, decrypted)
+
+	decrypted, err = s2.Decrypt(k1.Public, k1.Encrypt(k2.Public, msg))
+	assert.NoError(t, err, "should be compatible with KeyPair.Encrypt")
+	assert.Equal(t, msg, decrypted)
+
+	buf := make([]byte, 0, 1024)
+	sealed, err := s1.Seal(buf, k2.Public, msg)
+	assert.NoError(t, err)
+	assert.Equal(t, &buf[:1][0], &sealed[0], "should seal into the caller's buffer")
+	obuf := make([]byte, 0, 1024)
+	opened, err := s2.Open(obuf, k1.Public, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, msg, opened)
+	assert.Equal(t, &obuf[:1][0], &opened[0], "should open into the caller's buffer")
+
+	assert.NoError(t, s1.Close())
+	assert.False(t, s1.pair.Private.Valid(), "should zero the private key")
+	_, err = s1.Encrypt(k2.Public, msg)
+	assert.ErrorIs(t, err, ErrSessionClosed)
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	k1 := GenerateKeyPair()
+	k2 := GenerateKeyPair()
+	msg := make([]byte, 256)
+
+	b.Run("KeyPair", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			k1.Encrypt(k2.Public, msg)
+		}
+	})
+	b.Run("Session", func(b *testing.B) {
+		s := NewSession(k1)
+		defer s.Close()
+		buf := make([]byte, 0, len(msg)+NonceSize+box.Overhead)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = s.Seal(buf[:0], k2.Public, msg)
+		}
+	})
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	k1 := GenerateKeyPair()
+	k2 := GenerateKeyPair()
+	encrypted := k1.Encrypt(k2.Public, make([]byte, 256))
+
+	b.Run("KeyPair", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = k2.Decrypt(k1.Public, encrypted)
+		}
+	})
+	b.Run("Session", func(b *testing.B) {
+		s := NewSession(k2)
+		defer s.Close()
+		buf := make([]byte, 0, len(encrypted))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			_, _ = s.Open(buf[:0], k1.Public, encrypted)
+		}
+	})
+}
+
+func TestDeviceList(t *testing.T) {
+	identity := GenerateIdentityKeyPair()
+	d1 := GenerateKeyPair()
+	d2 := GenerateKeyPair()
+
+	list := identity.SignDeviceList([]Key{d1.Public, d2.Public}, 1)
+	assert.NoError(t, list.Verify())
+	assert.True(t, list.Contains(d1.Public))
+	assert.False(t, list.Contains(GenerateKeyPair().Public))
+
+	bs, err := json.Marshal(list)
+	assert.NoError(t, err)
+	var decoded DeviceList
+	assert.NoError(t, json.Unmarshal(bs, &decoded))
+	assert.NoError(t, decoded.Verify())
+
+	tampered := list
+	tampered.Version = 2
+	assert.Error(t, tampered.Verify())
+
+	tampered = identity.SignDeviceList([]Key{d1.Public}, 1)
+	tampered.Devices = []Key{GenerateKeyPair().Public}
+	assert.Error(t, tampered.Verify())
+}
+
+func TestFingerprintBinding(t *testing.T) {
+	k1 := GenerateKeyPair()
+	k2 := GenerateKeyPair()
+
+	fingerprint := "sha-256 ab:cd:ef"
+	binding := k1.BindFingerprint(k2.Public, fingerprint)
+	assert.NoError(t, k2.VerifyFingerprint(k1.Public, fingerprint, binding))
+	assert.Error(t, k2.VerifyFingerprint(k1.Public, "sha-256 00:00:00", binding))
+	assert.Error(t, k2.VerifyFingerprint(GenerateKeyPair().Public, fingerprint, binding))
+
+	assert.Equal(t, k1.DeriveSecret("a", 32), k1.DeriveSecret("a", 32))
+	assert.NotEqual(t, k1.DeriveSecret("a", 32), k1.DeriveSecret("b", 32))
+}
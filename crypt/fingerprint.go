@@ -0,0 +1,41 @@
+package crypt
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+)
+
+// DeriveSecret deterministically derives a secret of the given size from the
+// private key. Different labels produce independent secrets.
+func (pair *KeyPair) DeriveSecret(label string, size int) []byte {
+	secret, err := hkdf.Key(sha256.New, pair.Private[:], nil, label, size)
+	if err != nil {
+		panic(err)
+	}
+	return secret
+}
+
+// BindFingerprint binds a DTLS certificate fingerprint to the key pair, so a
+// peer can verify the certificate used for a WebRTC connection belongs to us.
+func (pair *KeyPair) BindFingerprint(peerPublicKey Key, fingerprint string) []byte {
+	return pair.Encrypt(peerPublicKey, fingerprintMessage(fingerprint))
+}
+
+// VerifyFingerprint verifies a fingerprint was bound to the peer's key with
+// BindFingerprint.
+func (pair *KeyPair) VerifyFingerprint(peerPublicKey Key, fingerprint string, binding []byte) error {
+	msg, err := pair.Decrypt(peerPublicKey, binding)
+	if err != nil {
+		return errors.New("invalid fingerprint binding")
+	}
+	if subtle.ConstantTimeCompare(msg, fingerprintMessage(fingerprint)) != 1 {
+		return errors.New("fingerprint does not match binding")
+	}
+	return nil
+}
+
+func fingerprintMessage(fingerprint string) []byte {
+	return []byte("rtctunnel dtls fingerprint v1:" + fingerprint)
+}
@@ -0,0 +1,182 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// An Encoding is a textual encoding for a key.
+type Encoding string
+
+const (
+	// EncodingBase58 is the default encoding used by Key.String
+	EncodingBase58 Encoding = "base58"
+	// EncodingBech32 is the checksummed "rtc1..." format
+	EncodingBech32 Encoding = "bech32"
+	// EncodingHex is lowercase hexadecimal
+	EncodingHex Encoding = "hex"
+	// EncodingBase64 is standard, padded base64
+	EncodingBase64 Encoding = "base64"
+	// EncodingPEM is PKCS#8 for private keys and PKIX for public keys
+	EncodingPEM Encoding = "pem"
+)
+
+// Encodings are the supported encodings.
+var Encodings = []Encoding{EncodingBase58, EncodingBech32, EncodingHex, EncodingBase64, EncodingPEM}
+
+// NewKeyPair creates a key pair from a private key, deriving the public key.
+// The key pair has no post-quantum key pair.
+func NewKeyPair(private Key) (KeyPair, error) {
+	pub, err := curve25519.X25519(private[:], curve25519.Basepoint)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	pair := KeyPair{Private: private}
+	copy(pair.Public[:], pub)
+	return pair, nil
+}
+
+// Encode encodes a raw key using the given encoding. private indicates whether
+// the key is a private key, which matters for PEM.
+func (key Key) Encode(enc Encoding, private bool) (string, error) {
+	switch enc {
+	case EncodingBase58, "":
+		return key.String(), nil
+	case EncodingBech32:
+		return key.Checksummed(), nil
+	case EncodingHex:
+		return hex.EncodeToString(key[:]), nil
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString(key[:]), nil
+	case EncodingPEM:
+		var block *pem.Block
+		if private {
+			k, err := ecdh.X25519().NewPrivateKey(key[:])
+			if err != nil {
+				return "", err
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(k)
+			if err != nil {
+				return "", err
+			}
+			block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		} else {
+			k, err := ecdh.X25519().NewPublicKey(key[:])
+			if err != nil {
+				return "", err
+			}
+			der, err := x509.MarshalPKIXPublicKey(k)
+			if err != nil {
+				return "", err
+			}
+			block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+		}
+		return string(pem.EncodeToMemory(block)), nil
+	default:
+		return "", fmt.Errorf("unknown key encoding: %s", enc)
+	}
+}
+
+// DecodeKey decodes a key using the given encoding. If the encoding is empty,
+// it is detected from the data.
+func DecodeKey(enc Encoding, str string) (key Key, err error) {
+	str = strings.TrimSpace(str)
+	if enc == "" {
+		enc = detectEncoding(str)
+	}
+
+	var bs []byte
+	switch enc {
+	case EncodingBase58:
+		return NewKey(str)
+	case EncodingBech32:
+		if !hasChecksummedPrefix(str) {
+			return key, errors.New("invalid key: expected a key starting with " + bech32HRP + "1")
+		}
+		return decodeChecksummed(str)
+	case EncodingHex:
+		bs, err = hex.DecodeString(str)
+	case EncodingBase64:
+		bs, err = base64.StdEncoding.DecodeString(str)
+	case EncodingPEM:
+		bs, err = decodePEM(str)
+	default:
+		return key, fmt.Errorf("unknown key encoding: %s", enc)
+	}
+	if err != nil {
+		return key, err
+	}
+	if len(bs) != KeySize {
+		return key, errors.New("invalid key")
+	}
+	copy(key[:], bs)
+	return key, nil
+}
+
+// DecodeKeyPair decodes a private key using the given encoding and derives the
+// key pair. If the encoding is empty, it is detected from the data.
+func DecodeKeyPair(enc Encoding, str string) (KeyPair, error) {
+	if strings.Contains(str, "-----BEGIN PUBLIC KEY") {
+		return KeyPair{}, errors.New("invalid private key: got a public key")
+	}
+	private, err := DecodeKey(enc, str)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	return NewKeyPair(private)
+}
+
+func detectEncoding(str string) Encoding {
+	switch {
+	case strings.HasPrefix(str, "-----BEGIN"):
+		return EncodingPEM
+	case isChecksummed(str):
+		return EncodingBech32
+	case len(str) == hex.EncodedLen(KeySize):
+		return EncodingHex
+	case len(str) == base64.StdEncoding.EncodedLen(KeySize) && strings.HasSuffix(str, "="):
+		return EncodingBase64
+	default:
+		return EncodingBase58
+	}
+}
+
+func decodePEM(str string) ([]byte, error) {
+	block, _ := pem.Decode([]byte(str))
+	if block == nil {
+		return nil, errors.New("invalid pem key")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		private, ok := k.(*ecdh.PrivateKey)
+		if !ok || private.Curve() != ecdh.X25519() {
+			return nil, errors.New("invalid pem key: not an X25519 private key")
+		}
+		return bytes.Clone(private.Bytes()), nil
+	case "PUBLIC KEY":
+		k, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		public, ok := k.(*ecdh.PublicKey)
+		if !ok || public.Curve() != ecdh.X25519() {
+			return nil, errors.New("invalid pem key: not an X25519 public key")
+		}
+		return bytes.Clone(public.Bytes()), nil
+	default:
+		return nil, fmt.Errorf("invalid pem key: unsupported type %s", block.Type)
+	}
+}
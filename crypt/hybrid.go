@@ -0,0 +1,227 @@
+package crypt
+
+import (
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// PostQuantumKeySize is the size of a post-quantum (ML-KEM-768) public key in
+// bytes
+const PostQuantumKeySize = mlkem.EncapsulationKeySize768
+
+// A PostQuantumKey is the ML-KEM-768 encapsulation key of a peer.
+type PostQuantumKey []byte
+
+// A PostQuantumKeyPair is an ML-KEM-768 key pair. It's stored as its seed.
+type PostQuantumKeyPair struct {
+	dk *mlkem.DecapsulationKey768
+}
+
+// GeneratePostQuantumKeyPair generates a new post-quantum key pair from a
+// random seed.
+func GeneratePostQuantumKeyPair() *PostQuantumKeyPair {
+	dk, err := mlkem.GenerateKey768()
+	if err != nil {
+		panic(err)
+	}
+	return &PostQuantumKeyPair{dk: dk}
+}
+
+// NewPostQuantumKeyPair creates a post-quantum key pair from a seed returned by
+// PostQuantumKeyPair.Seed.
+func NewPostQuantumKeyPair(seed []byte) (*PostQuantumKeyPair, error) {
+	dk, err := mlkem.NewDecapsulationKey768(seed)
+	if err != nil {
+		return nil, errors.New("invalid post-quantum seed")
+	}
+	return &PostQuantumKeyPair{dk: dk}, nil
+}
+
+// Seed returns the seed the key pair can be recreated from.
+func (pq *PostQuantumKeyPair) Seed() []byte {
+	return pq.dk.Bytes()
+}
+
+// PublicKey returns the post-quantum key peers use to encrypt messages.
+func (pq *PostQuantumKeyPair) PublicKey() PostQuantumKey {
+	return pq.dk.EncapsulationKey().Bytes()
+}
+
+func (pq *PostQuantumKeyPair) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pq.Seed())
+}
+
+func (pq *PostQuantumKeyPair) UnmarshalJSON(data []byte) error {
+	var seed []byte
+	err := json.Unmarshal(data, &seed)
+	if err != nil {
+		return err
+	}
+	return pq.setSeed(seed)
+}
+
+func (pq *PostQuantumKeyPair) MarshalYAML() (interface{}, error) {
+	return base64.StdEncoding.EncodeToString(pq.Seed()), nil
+}
+
+func (pq *PostQuantumKeyPair) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	err := unmarshal(&str)
+	if err != nil {
+		return err
+	}
+	seed, err := base64.StdEncoding.DecodeString(str)
+	if err != nil {
+		return errors.New("invalid post-quantum seed")
+	}
+	return pq.setSeed(seed)
+}
+
+func (pq *PostQuantumKeyPair) setSeed(seed []byte) error {
+	parsed, err := NewPostQuantumKeyPair(seed)
+	if err != nil {
+		return err
+	}
+	*pq = *parsed
+	return nil
+}
+
+// ParsePostQuantumKey parses a post-quantum key in the format returned by
+// PostQuantumKey.String.
+func ParsePostQuantumKey(str string) (PostQuantumKey, error) {
+	bs, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return nil, errors.New("invalid post-quantum key")
+	}
+	key := PostQuantumKey(bs)
+	if !key.Valid() {
+		return nil, errors.New("invalid post-quantum key")
+	}
+	return key, nil
+}
+
+// Valid returns true if the key is a valid ML-KEM-768 encapsulation key.
+func (key PostQuantumKey) Valid() bool {
+	_, err := mlkem.NewEncapsulationKey768(key)
+	return err == nil
+}
+
+// String returns the key in base64, the same as its JSON encoding.
+func (key PostQuantumKey) String() string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func (key PostQuantumKey) MarshalYAML() (interface{}, error) {
+	return key.String(), nil
+}
+
+func (key *PostQuantumKey) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	err := unmarshal(&str)
+	if err != nil {
+		return err
+	}
+	if str == "" {
+		*key = nil
+		return nil
+	}
+	*key, err = ParsePostQuantumKey(str)
+	return err
+}
+
+// PostQuantumKey returns the post-quantum public key for the key pair. It must
+// be sent to peers so they can use EncryptHybrid. It's nil if the key pair
+// doesn't have a post-quantum key pair.
+func (pair *KeyPair) PostQuantumKey() PostQuantumKey {
+	if pair.PostQuantum == nil {
+		return nil
+	}
+	return pair.PostQuantum.PublicKey()
+}
+
+// EncryptHybrid encrypts a message using both X25519 and ML-KEM-768. An attacker
+// has to break both to read the message, so recorded messages stay private
+// even if X25519 is broken in the future.
+func (pair *KeyPair) EncryptHybrid(peerPublicKey Key, peerPostQuantumKey PostQuantumKey, data []byte) ([]byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(peerPostQuantumKey)
+	if err != nil {
+		return nil, errors.New("invalid post-quantum key")
+	}
+	sharedKey, ciphertext := ek.Encapsulate()
+
+	key, err := pair.hybridKey(pair.Public, peerPublicKey, peerPublicKey, sharedKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := generateNonce()
+	var result []byte
+	result = append(result, ciphertext...)
+	result = append(result, nonce[:]...)
+	return secretbox.Seal(result, data, &nonce, &key), nil
+}
+
+// DecryptHybrid decrypts a message encrypted with EncryptHybrid.
+func (pair *KeyPair) DecryptHybrid(peerPublicKey Key, data []byte) ([]byte, error) {
+	if len(data) < mlkem.CiphertextSize768+NonceSize {
+		return nil, errors.New("invalid message")
+	}
+	ciphertext := data[:mlkem.CiphertextSize768]
+	var nonce Nonce
+	copy(nonce[:], data[mlkem.CiphertextSize768:])
+	sealed := data[mlkem.CiphertextSize768+NonceSize:]
+
+	if pair.PostQuantum == nil {
+		return nil, errors.New("missing post-quantum key")
+	}
+	sharedKey, err := pair.PostQuantum.dk.Decapsulate(ciphertext)
+	if err != nil {
+		return nil, errors.New("invalid message")
+	}
+
+	key, err := pair.hybridKey(peerPublicKey, pair.Public, peerPublicKey, sharedKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	opened, ok := secretbox.Open(nil, sealed, &nonce, &key)
+	if !ok {
+		return nil, errors.New("invalid message")
+	}
+	return opened, nil
+}
+
+// hybridKey combines the X25519 and ML-KEM shared secrets into a single key,
+// bound to the sender, recipient and ML-KEM ciphertext.
+func (pair *KeyPair) hybridKey(sender, recipient, peerPublicKey Key, pqSharedKey, ciphertext []byte) ([KeySize]byte, error) {
+	var key [KeySize]byte
+
+	var classicalSharedKey [KeySize]byte
+	k1 := [KeySize]byte(peerPublicKey)
+	k2 := [KeySize]byte(pair.Private)
+	box.Precompute(&classicalSharedKey, &k1, &k2)
+
+	var secret []byte
+	secret = append(secret, classicalSharedKey[:]...)
+	secret = append(secret, pqSharedKey...)
+
+	var salt []byte
+	salt = append(salt, sender[:]...)
+	salt = append(salt, recipient[:]...)
+	salt = append(salt, ciphertext...)
+
+	bs, err := hkdf.Key(sha256.New, secret, salt, "rtctunnel hybrid x25519 ml-kem-768 v1", KeySize)
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], bs)
+	return key, nil
+}
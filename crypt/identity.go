@@ -0,0 +1,88 @@
+package crypt
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+type (
+	// An IdentityKeyPair is a long-term signing key pair which authorizes the
+	// key pairs of several devices to act as a single logical peer. The
+	// private key is the ed25519 seed.
+	IdentityKeyPair struct {
+		Public, Private Key
+	}
+
+	// A DeviceList is the list of device keys authorized by an identity.
+	DeviceList struct {
+		Identity Key
+		Devices  []Key
+		// Version increases every time the list is changed, so older lists
+		// can be rejected
+		Version   uint64
+		Signature []byte
+	}
+)
+
+// GenerateIdentityKeyPair generates a new identity key pair.
+func GenerateIdentityKeyPair() IdentityKeyPair {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	var pair IdentityKeyPair
+	copy(pair.Public[:], pub)
+	copy(pair.Private[:], priv.Seed())
+	return pair
+}
+
+// SignDeviceList creates a signed list of the devices authorized by the
+// identity.
+func (pair IdentityKeyPair) SignDeviceList(devices []Key, version uint64) DeviceList {
+	list := DeviceList{
+		Identity: pair.Public,
+		Devices:  append([]Key(nil), devices...),
+		Version:  version,
+	}
+	priv := ed25519.NewKeyFromSeed(pair.Private[:])
+	list.Signature = ed25519.Sign(priv, list.signedMessage())
+	return list
+}
+
+// Verify verifies the device list was signed by its identity.
+func (list DeviceList) Verify() error {
+	if !list.Identity.Valid() {
+		return errors.New("invalid device list: missing identity")
+	}
+	if len(list.Devices) == 0 {
+		return errors.New("invalid device list: no devices")
+	}
+	if !ed25519.Verify(list.Identity[:], list.signedMessage(), list.Signature) {
+		return errors.New("invalid device list: bad signature")
+	}
+	return nil
+}
+
+// Contains returns true if the device key is authorized by the identity.
+func (list DeviceList) Contains(device Key) bool {
+	for _, d := range list.Devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
+func (list DeviceList) signedMessage() []byte {
+	var msg []byte
+	msg = append(msg, "rtctunnel device list v1"...)
+	msg = append(msg, list.Identity[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, list.Version)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(list.Devices)))
+	for _, d := range list.Devices {
+		msg = append(msg, d[:]...)
+	}
+	return msg
+}
@@ -0,0 +1,65 @@
+package crypt
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tyler-smith/go-bip39"
+)
+
+// SeedSize is the size of a key pair seed in bytes
+const SeedSize = KeySize
+
+// GenerateSeed generates a random seed for KeyPairFromSeed.
+func GenerateSeed() []byte {
+	seed := make([]byte, SeedSize)
+	if _, err := io.ReadFull(rand.Reader, seed); err != nil {
+		panic(err)
+	}
+	return seed
+}
+
+// KeyPairFromSeed deterministically derives a key pair from a seed. The seed is
+// used as the private key, so every key pair, including ones from
+// GenerateKeyPair, has a seed and can be backed up as a mnemonic.
+func KeyPairFromSeed(seed []byte) (KeyPair, error) {
+	if len(seed) != SeedSize {
+		return KeyPair{}, fmt.Errorf("invalid seed: expected %d bytes, got %d", SeedSize, len(seed))
+	}
+	var private Key
+	copy(private[:], seed)
+	if !private.Valid() {
+		return KeyPair{}, errors.New("invalid seed: all zeros")
+	}
+	return NewKeyPair(private)
+}
+
+// Seed returns the seed the key pair can be derived from.
+func (pair KeyPair) Seed() []byte {
+	seed := make([]byte, SeedSize)
+	copy(seed, pair.Private[:])
+	return seed
+}
+
+// Mnemonic returns a 24 word BIP-39 recovery phrase for the key pair.
+func (pair KeyPair) Mnemonic() (string, error) {
+	if !pair.Private.Valid() {
+		return "", errors.New("missing private key")
+	}
+	return bip39.NewMnemonic(pair.Seed())
+}
+
+// KeyPairFromMnemonic recovers a key pair from a recovery phrase created by
+// KeyPair.Mnemonic. The phrase doesn't include the post-quantum key pair, so
+// the recovered key pair has none.
+func KeyPairFromMnemonic(mnemonic string) (KeyPair, error) {
+	mnemonic = strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	seed, err := bip39.EntropyFromMnemonic(mnemonic)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("invalid mnemonic: %w", err)
+	}
+	return KeyPairFromSeed(seed)
+}
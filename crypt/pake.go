@@ -0,0 +1,186 @@
+package crypt
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"filippo.io/edwards25519"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// A PAKERole is the side of a password-authenticated key exchange. The two
+// sides of an exchange must use different roles.
+type PAKERole int
+
+const (
+	// PAKERoleA is the side that starts the exchange
+	PAKERoleA PAKERole = iota
+	// PAKERoleB is the side that joins the exchange
+	PAKERoleB
+)
+
+var (
+	pakeM = hashToPoint("rtctunnel spake2 M")
+	pakeN = hashToPoint("rtctunnel spake2 N")
+)
+
+// A PAKE is one side of a SPAKE2 password-authenticated key exchange over
+// edwards25519. Both sides derive the same session key only if they used the
+// same password, and an attacker gets a single guess per exchange.
+type PAKE struct {
+	role     PAKERole
+	w, x     *edwards25519.Scalar
+	msg      []byte
+	finished bool
+
+	sessionKey                  Key
+	confirmation, peerConfirmed []byte
+}
+
+// NewPAKE starts a password-authenticated key exchange.
+func NewPAKE(role PAKERole, password []byte) *PAKE {
+	h := sha512.New()
+	h.Write([]byte("rtctunnel spake2 password"))
+	h.Write(password)
+	w, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+
+	var seed [64]byte
+	if _, err := io.ReadFull(rand.Reader, seed[:]); err != nil {
+		panic(err)
+	}
+	x, err := edwards25519.NewScalar().SetUniformBytes(seed[:])
+	if err != nil {
+		panic(err)
+	}
+
+	mask := pakeM
+	if role == PAKERoleB {
+		mask = pakeN
+	}
+	X := new(edwards25519.Point).ScalarBaseMult(x)
+	X.Add(X, new(edwards25519.Point).ScalarMult(w, mask))
+
+	return &PAKE{
+		role: role,
+		w:    w,
+		x:    x,
+		msg:  X.Bytes(),
+	}
+}
+
+// Message returns the message to send to the peer.
+func (p *PAKE) Message() []byte {
+	return p.msg
+}
+
+// Finish completes the exchange using the peer's message.
+func (p *PAKE) Finish(peerMessage []byte) error {
+	if p.finished {
+		return errors.New("pake already finished")
+	}
+	Y, err := new(edwards25519.Point).SetBytes(peerMessage)
+	if err != nil {
+		return errors.New("invalid pake message")
+	}
+
+	peerMask := pakeN
+	msgA, msgB := p.msg, peerMessage
+	if p.role == PAKERoleB {
+		peerMask = pakeM
+		msgA, msgB = peerMessage, p.msg
+	}
+
+	T := new(edwards25519.Point).Subtract(Y, new(edwards25519.Point).ScalarMult(p.w, peerMask))
+	T.MultByCofactor(T)
+	Z := new(edwards25519.Point).ScalarMult(p.x, T)
+	if Z.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return errors.New("invalid pake message")
+	}
+
+	transcript := sha512.New()
+	for _, part := range [][]byte{msgA, msgB, Z.Bytes(), p.w.Bytes()} {
+		_ = binary.Write(transcript, binary.LittleEndian, uint64(len(part)))
+		transcript.Write(part)
+	}
+	sum := transcript.Sum(nil)
+	copy(p.sessionKey[:], sum[:KeySize])
+	confirmationKey := sum[KeySize:]
+
+	confirmA := pakeMAC(confirmationKey, "A", sum)
+	confirmB := pakeMAC(confirmationKey, "B", sum)
+	if p.role == PAKERoleA {
+		p.confirmation, p.peerConfirmed = confirmA, confirmB
+	} else {
+		p.confirmation, p.peerConfirmed = confirmB, confirmA
+	}
+	p.finished = true
+	return nil
+}
+
+// Confirmation returns a key confirmation to send to the peer. It is only
+// valid after Finish.
+func (p *PAKE) Confirmation() []byte {
+	return p.confirmation
+}
+
+// VerifyConfirmation verifies the peer's key confirmation. It fails if the
+// peer used a different password.
+func (p *PAKE) VerifyConfirmation(confirmation []byte) error {
+	if !p.finished || !hmac.Equal(confirmation, p.peerConfirmed) {
+		return errors.New("pake confirmation failed")
+	}
+	return nil
+}
+
+// Seal encrypts data with the session key.
+func (p *PAKE) Seal(data []byte) []byte {
+	nonce := generateNonce()
+	k := [KeySize]byte(p.sessionKey)
+	return secretbox.Seal(nonce[:], data, &nonce, &k)
+}
+
+// Open decrypts data with the session key.
+func (p *PAKE) Open(data []byte) ([]byte, error) {
+	if !p.finished || len(data) < NonceSize {
+		return nil, errors.New("invalid message")
+	}
+	var nonce Nonce
+	copy(nonce[:], data)
+	k := [KeySize]byte(p.sessionKey)
+	opened, ok := secretbox.Open(nil, data[NonceSize:], &nonce, &k)
+	if !ok {
+		return nil, errors.New("invalid message")
+	}
+	return opened, nil
+}
+
+func pakeMAC(key []byte, label string, transcript []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(label))
+	m.Write(transcript)
+	return m.Sum(nil)
+}
+
+// hashToPoint derives a point with no known discrete log from a seed.
+func hashToPoint(seed string) *edwards25519.Point {
+	for i := 0; ; i++ {
+		h := sha256.Sum256(append([]byte(seed), byte(i)))
+		p, err := new(edwards25519.Point).SetBytes(h[:])
+		if err != nil {
+			continue
+		}
+		p.MultByCofactor(p)
+		if p.Equal(edwards25519.NewIdentityPoint()) == 1 {
+			continue
+		}
+		return p
+	}
+}
@@ -0,0 +1,64 @@
+package crypt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// A Rotation announces that a key pair has been replaced by a new one.
+//
+// A Rotation is meant to be sent to a peer encrypted with the old key pair, which
+// authenticates the old key. The Proof shows that the sender also holds the
+// private half of the new key.
+type Rotation struct {
+	Old, New Key
+	// Expires is when the old key stops being valid
+	Expires time.Time
+	Proof   []byte
+	// PostQuantumKey is the new key pair's post-quantum key, if it has one
+	PostQuantumKey PostQuantumKey `json:",omitempty"`
+}
+
+// NewRotation creates a new Rotation from old to new, addressed to a peer.
+func NewRotation(old, new KeyPair, peerPublicKey Key, expires time.Time) Rotation {
+	r := Rotation{
+		Old:     old.Public,
+		New:     new.Public,
+		Expires: expires.UTC().Truncate(time.Second),
+
+		PostQuantumKey: new.PostQuantumKey(),
+	}
+	r.Proof = new.Encrypt(peerPublicKey, r.proofMessage())
+	return r
+}
+
+// Verify verifies that the rotation was created by the owner of the new key and
+// addressed to the given key pair.
+func (r Rotation) Verify(pair KeyPair) error {
+	if !r.Old.Valid() || !r.New.Valid() {
+		return errors.New("invalid rotation: missing key")
+	}
+	if r.Old == r.New {
+		return errors.New("invalid rotation: old and new keys are the same")
+	}
+	if len(r.PostQuantumKey) > 0 && !r.PostQuantumKey.Valid() {
+		return errors.New("invalid rotation: invalid post-quantum key")
+	}
+	msg, err := pair.Decrypt(r.New, r.Proof)
+	if err != nil {
+		return errors.New("invalid rotation: bad proof")
+	}
+	if !bytes.Equal(msg, r.proofMessage()) {
+		return errors.New("invalid rotation: bad proof")
+	}
+	return nil
+}
+
+func (r Rotation) proofMessage() []byte {
+	var msg []byte
+	msg = append(msg, r.Old[:]...)
+	msg = binary.BigEndian.AppendUint64(msg, uint64(r.Expires.Unix()))
+	return msg
+}
@@ -0,0 +1,151 @@
+package crypt
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// ErrSessionClosed is returned when using a closed Session.
+var ErrSessionClosed = errors.New("session closed")
+
+// A Session encrypts and decrypts messages like KeyPair.Encrypt and
+// KeyPair.Decrypt, but caches the shared key for each peer so the X25519
+// scalar multiplication only happens once per peer. Messages are compatible
+// with KeyPair.Encrypt and KeyPair.Decrypt.
+//
+// A Session is safe for concurrent use.
+type Session struct {
+	mu     sync.RWMutex
+	pair   KeyPair
+	shared map[Key]*[KeySize]byte
+	closed bool
+	public Key
+}
+
+// NewSession creates a new Session for a key pair.
+func NewSession(pair KeyPair) *Session {
+	return &Session{
+		pair:   pair,
+		shared: make(map[Key]*[KeySize]byte),
+		public: pair.Public,
+	}
+}
+
+// PublicKey returns the public key of the session's key pair.
+func (s *Session) PublicKey() Key {
+	return s.public
+}
+
+// Encrypt encrypts a message for a peer.
+func (s *Session) Encrypt(peerPublicKey Key, data []byte) ([]byte, error) {
+	return s.Seal(nil, peerPublicKey, data)
+}
+
+// Decrypt decrypts a message from a peer.
+func (s *Session) Decrypt(peerPublicKey Key, data []byte) ([]byte, error) {
+	return s.Open(nil, peerPublicKey, data)
+}
+
+// Seal encrypts a message for a peer and appends the result to out. If out has
+// enough capacity (len(data) + NonceSize + box.Overhead) no memory is
+// allocated. out must not overlap data.
+func (s *Session) Seal(out []byte, peerPublicKey Key, data []byte) ([]byte, error) {
+	shared, err := s.rlockSharedKey(peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	nonce := generateNonce()
+	out = append(out, nonce[:]...)
+	return box.SealAfterPrecomputation(out, data, &nonce, shared), nil
+}
+
+// Open decrypts a message from a peer and appends the result to out. If out has
+// enough capacity no memory is allocated. out must not overlap data.
+func (s *Session) Open(out []byte, peerPublicKey Key, data []byte) ([]byte, error) {
+	if len(data) < NonceSize {
+		return nil, errors.New("invalid message")
+	}
+	shared, err := s.rlockSharedKey(peerPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer s.mu.RUnlock()
+
+	var nonce Nonce
+	copy(nonce[:], data)
+	opened, ok := box.OpenAfterPrecomputation(out, data[NonceSize:], &nonce, shared)
+	if !ok {
+		return nil, errors.New("invalid message")
+	}
+	return opened, nil
+}
+
+// Forget removes the cached shared key for a peer.
+func (s *Session) Forget(peerPublicKey Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if shared, ok := s.shared[peerPublicKey]; ok {
+		zero(shared[:])
+		delete(s.shared, peerPublicKey)
+	}
+}
+
+// Close zeroes the private key and all the cached shared keys. The session can't
+// be used afterwards.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for peerPublicKey, shared := range s.shared {
+		zero(shared[:])
+		delete(s.shared, peerPublicKey)
+	}
+	zero(s.pair.Private[:])
+	return nil
+}
+
+// rlockSharedKey returns the shared key for a peer with the read lock held, so
+// the key can't be zeroed while it's in use.
+func (s *Session) rlockSharedKey(peerPublicKey Key) (*[KeySize]byte, error) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		return nil, ErrSessionClosed
+	}
+	if shared, ok := s.shared[peerPublicKey]; ok {
+		return shared, nil
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrSessionClosed
+	}
+	if _, ok := s.shared[peerPublicKey]; !ok {
+		shared := new([KeySize]byte)
+		k1 := [KeySize]byte(peerPublicKey)
+		k2 := [KeySize]byte(s.pair.Private)
+		box.Precompute(shared, &k1, &k2)
+		zero(k2[:])
+		s.shared[peerPublicKey] = shared
+	}
+	s.mu.Unlock()
+
+	return s.rlockSharedKey(peerPublicKey)
+}
+
+func zero(bs []byte) {
+	for i := range bs {
+		bs[i] = 0
+	}
+}
@@ -0,0 +1,86 @@
+package crypt
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fdKeys caches keys read from file descriptors, since they can only be read
+// once.
+var fdKeys = struct {
+	sync.Mutex
+	m map[int]string
+}{
+	m: make(map[int]string),
+}
+
+// LoadKeyPair loads a private key from an external source and derives the key
+// pair. The source is one of:
+//
+//	file:<path>  a file containing the key
+//	env:<name>   an environment variable containing the key
+//	fd:<number>  an open file descriptor to read the key from
+//
+// The key may be in any of the supported Encodings.
+func LoadKeyPair(source string) (KeyPair, error) {
+	data, err := readKeySource(source)
+	if err != nil {
+		return KeyPair{}, err
+	}
+	pair, err := DecodeKeyPair("", data)
+	if err != nil {
+		return KeyPair{}, fmt.Errorf("invalid key from %s: %w", source, err)
+	}
+	return pair, nil
+}
+
+func readKeySource(source string) (string, error) {
+	scheme, value, ok := strings.Cut(source, ":")
+	if !ok || value == "" {
+		return "", fmt.Errorf("invalid key source %q, expected file:<path>, env:<name> or fd:<number>", source)
+	}
+
+	switch scheme {
+	case "file":
+		bs, err := os.ReadFile(value)
+		if err != nil {
+			return "", err
+		}
+		return string(bs), nil
+	case "env":
+		data, ok := os.LookupEnv(value)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", value)
+		}
+		return data, nil
+	case "fd":
+		fd, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid file descriptor %q", value)
+		}
+
+		fdKeys.Lock()
+		defer fdKeys.Unlock()
+
+		if data, ok := fdKeys.m[fd]; ok {
+			return data, nil
+		}
+		f := os.NewFile(uintptr(fd), "key")
+		if f == nil {
+			return "", fmt.Errorf("invalid file descriptor %d", fd)
+		}
+		defer f.Close()
+		bs, err := io.ReadAll(f)
+		if err != nil {
+			return "", err
+		}
+		fdKeys.m[fd] = string(bs)
+		return string(bs), nil
+	default:
+		return "", fmt.Errorf("unknown key source scheme %q", scheme)
+	}
+}
@@ -3,6 +3,7 @@ module github.com/rtctunnel/rtctunnel
 go 1.24
 
 require (
+	filippo.io/edwards25519 v1.1.0
 	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	github.com/kirsle/configdir v0.0.0-20170128060238-e45d2f54772f
@@ -12,7 +13,9 @@ require (
 	github.com/rs/zerolog v1.34.0
 	github.com/spf13/cobra v1.9.1
 	github.com/stretchr/testify v1.10.0
+	github.com/tyler-smith/go-bip39 v1.1.0
 	golang.org/x/crypto v0.36.0
+	golang.org/x/net v0.36.0
 	golang.org/x/sync v0.12.0
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -40,7 +43,6 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
 	github.com/wlynxg/anet v0.0.3 // indirect
-	golang.org/x/net v0.36.0 // indirect
 	golang.org/x/sys v0.31.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
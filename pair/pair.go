@@ -0,0 +1,228 @@
+// Package pair exchanges public keys between two peers using a short one-time
+// code, like 7-purple-sausage.
+//
+// The code is used as the password for a password-authenticated key exchange
+// over a signal channel, so the channel operator (or anyone else watching it)
+// can't learn or substitute the exchanged keys, and an attacker only gets a
+// single guess at the code.
+package pair
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/rtctunnel/rtctunnel/channels"
+	"github.com/rtctunnel/rtctunnel/crypt"
+)
+
+// maxNameplate is the largest nameplate used in generated codes.
+const maxNameplate = 999
+
+// A Result is the outcome of a successful pairing.
+type Result struct {
+	PeerPublicKey crypt.Key
+	// Info is the extra information sent by the peer
+	Info []byte
+}
+
+type payload struct {
+	PublicKey crypt.Key
+	Info      []byte `json:",omitempty"`
+}
+
+type message struct {
+	PAKE         []byte `json:",omitempty"`
+	Confirmation []byte `json:",omitempty"`
+	Sealed       []byte `json:",omitempty"`
+}
+
+// GenerateCode generates a new random pairing code.
+func GenerateCode() string {
+	var bs [2]byte
+	if _, err := rand.Read(bs[:]); err != nil {
+		panic(err)
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(maxNameplate))
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%d-%s-%s", n.Int64()+1, words[bs[0]], words[bs[1]])
+}
+
+// ParseCode validates a pairing code and returns its nameplate, which is used
+// to find the peer on the signal channel.
+func ParseCode(code string) (nameplate string, err error) {
+	parts := strings.Split(strings.ToLower(strings.TrimSpace(code)), "-")
+	if len(parts) < 3 {
+		return "", errors.New("invalid pairing code: expected a number followed by two or more words, e.g. 7-purple-sausage")
+	}
+	if n, err := strconv.Atoi(parts[0]); err != nil || n <= 0 {
+		return "", fmt.Errorf("invalid pairing code: %q is not a number", parts[0])
+	}
+	for _, part := range parts[1:] {
+		if !isWord(part) {
+			return "", fmt.Errorf("invalid pairing code: unknown word %q", part)
+		}
+	}
+	return parts[0], nil
+}
+
+// Start starts a pairing using a code from GenerateCode. It waits for the peer
+// to Join with the same code.
+func Start(ch channels.Channel, code string, publicKey crypt.Key, info []byte) (*Result, error) {
+	nameplate, err := ParseCode(code)
+	if err != nil {
+		return nil, err
+	}
+	pake := crypt.NewPAKE(crypt.PAKERoleA, normalize(code))
+
+	msg, err := recv(ch, address(nameplate, crypt.PAKERoleB))
+	if err != nil {
+		return nil, err
+	}
+	err = pake.Finish(msg.PAKE)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := seal(pake, publicKey, info)
+	if err != nil {
+		return nil, err
+	}
+	err = send(ch, address(nameplate, crypt.PAKERoleA), &message{
+		PAKE:         pake.Message(),
+		Confirmation: pake.Confirmation(),
+		Sealed:       sealed,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = recv(ch, address(nameplate, crypt.PAKERoleB))
+	if err != nil {
+		return nil, err
+	}
+	err = pake.VerifyConfirmation(msg.Confirmation)
+	if err != nil {
+		return nil, errors.New("pairing failed: the peer used a different code")
+	}
+	return open(pake, msg.Sealed)
+}
+
+// Join joins a pairing started by a peer with the given code.
+func Join(ch channels.Channel, code string, publicKey crypt.Key, info []byte) (*Result, error) {
+	nameplate, err := ParseCode(code)
+	if err != nil {
+		return nil, err
+	}
+	pake := crypt.NewPAKE(crypt.PAKERoleB, normalize(code))
+
+	err = send(ch, address(nameplate, crypt.PAKERoleB), &message{
+		PAKE: pake.Message(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := recv(ch, address(nameplate, crypt.PAKERoleA))
+	if err != nil {
+		return nil, err
+	}
+	err = pake.Finish(msg.PAKE)
+	if err != nil {
+		return nil, err
+	}
+	err = pake.VerifyConfirmation(msg.Confirmation)
+	if err != nil {
+		return nil, errors.New("pairing failed: the peer used a different code")
+	}
+	result, err := open(pake, msg.Sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := seal(pake, publicKey, info)
+	if err != nil {
+		return nil, err
+	}
+	err = send(ch, address(nameplate, crypt.PAKERoleB), &message{
+		Confirmation: pake.Confirmation(),
+		Sealed:       sealed,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func address(nameplate string, role crypt.PAKERole) string {
+	side := "a"
+	if role == crypt.PAKERoleB {
+		side = "b"
+	}
+	return "rtctunnel-pair/" + nameplate + "/" + side
+}
+
+func normalize(code string) []byte {
+	return []byte(strings.ToLower(strings.TrimSpace(code)))
+}
+
+func isWord(str string) bool {
+	for _, w := range words {
+		if w == str {
+			return true
+		}
+	}
+	return false
+}
+
+func seal(pake *crypt.PAKE, publicKey crypt.Key, info []byte) ([]byte, error) {
+	bs, err := json.Marshal(payload{PublicKey: publicKey, Info: info})
+	if err != nil {
+		return nil, err
+	}
+	return pake.Seal(bs), nil
+}
+
+func open(pake *crypt.PAKE, sealed []byte) (*Result, error) {
+	bs, err := pake.Open(sealed)
+	if err != nil {
+		return nil, err
+	}
+	var p payload
+	err = json.Unmarshal(bs, &p)
+	if err != nil {
+		return nil, err
+	}
+	if !p.PublicKey.Valid() {
+		return nil, errors.New("pairing failed: the peer sent an invalid key")
+	}
+	return &Result{PeerPublicKey: p.PublicKey, Info: p.Info}, nil
+}
+
+func send(ch channels.Channel, address string, msg *message) error {
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return ch.Send(address, string(bs))
+}
+
+func recv(ch channels.Channel, address string) (*message, error) {
+	data, err := ch.Recv(address)
+	if err != nil {
+		return nil, err
+	}
+	var msg message
+	err = json.Unmarshal([]byte(data), &msg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pairing message: %w", err)
+	}
+	return &msg, nil
+}
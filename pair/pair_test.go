@@ -0,0 +1,70 @@
+package pair
+
+import (
+	"testing"
+
+	"github.com/rtctunnel/rtctunnel/channels"
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestPair(t *testing.T) {
+	ch, err := channels.Get("memory://pair-test")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+	code := GenerateCode()
+
+	var r1, r2 *Result
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		r1, err = Start(ch, code, key1.Public, []byte("from 1"))
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		r2, err = Join(ch, code, key2.Public, []byte("from 2"))
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	assert.Equal(t, key2.Public, r1.PeerPublicKey)
+	assert.Equal(t, []byte("from 2"), r1.Info)
+	assert.Equal(t, key1.Public, r2.PeerPublicKey)
+	assert.Equal(t, []byte("from 1"), r2.Info)
+}
+
+func TestPairWrongCode(t *testing.T) {
+	ch, err := channels.Get("memory://pair-test-wrong-code")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var eg errgroup.Group
+	eg.Go(func() error {
+		_, err := Start(ch, "7-purple-sausage", key1.Public, nil)
+		return err
+	})
+	_, err = Join(ch, "7-purple-pickle", key2.Public, nil)
+	assert.Error(t, err)
+	// unblock the starting side
+	_ = ch.Send(address("7", crypt.PAKERoleB), "{}")
+	assert.Error(t, eg.Wait())
+}
+
+func TestParseCode(t *testing.T) {
+	nameplate, err := ParseCode(" 7-Purple-Sausage ")
+	assert.NoError(t, err)
+	assert.Equal(t, "7", nameplate)
+
+	_, err = ParseCode("purple-sausage")
+	assert.Error(t, err)
+	_, err = ParseCode("7-purple-sausages")
+	assert.Error(t, err)
+
+	_, err = ParseCode(GenerateCode())
+	assert.NoError(t, err)
+}
@@ -0,0 +1,37 @@
+package pair
+
+// words are used to build pairing codes. There are 256 so each word adds 8 bits.
+var words = [256]string{
+	"acorn", "adult", "agent", "album", "alpha", "amber", "anchor", "angle",
+	"apple", "apron", "arena", "arrow", "atlas", "attic", "autumn", "avocado",
+	"badge", "bagel", "bakery", "ballet", "bamboo", "banana", "banjo", "barley",
+	"basket", "beacon", "beaver", "bicycle", "biscuit", "blanket", "blossom", "bonnet",
+	"bottle", "boulder", "bracelet", "breeze", "brick", "bridge", "broccoli", "bubble",
+	"bucket", "buffalo", "butter", "button", "cabin", "cactus", "camel", "candle",
+	"canoe", "canyon", "carpet", "carrot", "castle", "cattle", "celery", "cello",
+	"cement", "cherry", "chimney", "cinema", "circus", "citrus", "clover", "coconut",
+	"comet", "compass", "copper", "coral", "cotton", "cougar", "cowboy", "crayon",
+	"cricket", "crystal", "cupcake", "curtain", "cushion", "daisy", "dancer", "denim",
+	"desert", "diamond", "dinner", "dolphin", "donkey", "dragon", "drawer", "dream",
+	"eagle", "easel", "echo", "eclipse", "elbow", "elephant", "ember", "engine",
+	"falcon", "feather", "fence", "ferry", "fiddle", "fig", "finch", "fireplace",
+	"flamingo", "flute", "forest", "fossil", "fountain", "fox", "galaxy", "garden",
+	"garlic", "gazelle", "geyser", "ginger", "giraffe", "glacier", "globe", "goblet",
+	"gondola", "gorilla", "granite", "grape", "guitar", "hammer", "harbor", "harvest",
+	"hazel", "helmet", "heron", "hickory", "honey", "horizon", "hotel", "husky",
+	"igloo", "island", "ivory", "jacket", "jaguar", "jasmine", "jelly", "jigsaw",
+	"jungle", "kayak", "kettle", "kitten", "koala", "ladder", "lagoon", "lantern",
+	"laptop", "lemon", "leopard", "lettuce", "lighthouse", "lily", "lizard", "llama",
+	"lobster", "lotus", "magnet", "mango", "maple", "marble", "meadow", "melon",
+	"mermaid", "meteor", "mitten", "monkey", "mosaic", "muffin", "mushroom", "napkin",
+	"nectar", "needle", "noodle", "nutmeg", "oasis", "ocean", "octopus", "olive",
+	"onion", "orange", "orchid", "otter", "owl", "oyster", "paddle", "panda",
+	"panther", "papaya", "parrot", "peach", "peanut", "pebble", "pelican", "pencil",
+	"pepper", "piano", "pickle", "pillow", "pirate", "planet", "plum", "pocket",
+	"polar", "pony", "popcorn", "potato", "pretzel", "pumpkin", "puppy", "purple",
+	"quartz", "quilt", "rabbit", "radio", "rainbow", "raven", "ribbon", "river",
+	"robot", "rocket", "saddle", "salmon", "sandal", "sausage", "scarf", "scooter",
+	"shadow", "shell", "silver", "sketch", "sled", "socket", "spider", "sponge",
+	"squirrel", "stamp", "sunset", "tiger", "toast", "tomato", "tulip", "tunnel",
+	"turtle", "velvet", "violin", "walnut", "wizard", "yacht", "zebra", "zipper",
+}
@@ -0,0 +1,180 @@
+package peer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+)
+
+// An acceptQueue holds the connections waiting to be accepted. Data channels
+// are opened concurrently and queued in the order they finish opening, so one
+// which is slow to open doesn't hold up the others.
+type acceptQueue[T io.Closer] struct {
+	// slots limits the connections opening or waiting to be accepted
+	slots chan struct{}
+	ready chan T
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func newAcceptQueue[T io.Closer](backlog int) *acceptQueue[T] {
+	return &acceptQueue[T]{
+		slots: make(chan struct{}, backlog),
+		ready: make(chan T, backlog),
+	}
+}
+
+// add opens a connection in the background and queues it once it's open. It
+// returns false if the backlog is full. If open fails the connection is
+// dropped.
+func (q *acceptQueue[T]) add(open func() (T, error)) bool {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		return false
+	}
+
+	go func() {
+		c, err := open()
+		if err != nil {
+			<-q.slots
+			return
+		}
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.closed {
+			_ = c.Close()
+			return
+		}
+		// there's always room, since there are as many slots
+		q.ready <- c
+	}()
+	return true
+}
+
+// accepted frees the slot of a connection received from ready.
+func (q *acceptQueue[T]) accepted() {
+	<-q.slots
+}
+
+// close closes the connections waiting to be accepted, and any which finish
+// opening later.
+func (q *acceptQueue[T]) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	for {
+		select {
+		case c := <-q.ready:
+			_ = c.Close()
+			q.accepted()
+		default:
+			return
+		}
+	}
+}
+
+// An acceptedStream is a stream waiting to be accepted.
+type acceptedStream struct {
+	net.Conn
+	peerPublicKey crypt.Key
+	target        Target
+}
+
+// An acceptedPacketConn is a packet connection waiting to be accepted.
+type acceptedPacketConn struct {
+	net.PacketConn
+	peerPublicKey crypt.Key
+	target        Target
+}
+
+// acceptDataChannel queues a data channel opened by the peer to be accepted
+// as a stream.
+func (conn *Conn) acceptDataChannel(pc RTCPeerConnection, peerPublicKey crypt.Key, dc RTCDataChannel) {
+	lbl := dc.Label()
+	target, ok := parseStreamLabel(lbl)
+	if !ok {
+		conn.log.Info().Str("label", lbl).Msg("ignoring datachannel")
+		return
+	}
+
+	// register the handlers now, so messages sent before it opens aren't
+	// lost, and only wait for it to open in the background
+	stream := newDataChannel(dc)
+	ok = conn.streams.add(func() (acceptedStream, error) {
+		err := stream.waitOpen()
+		if errors.Is(err, ErrClosedByPeer) {
+			conn.log.Info().Str("label", lbl).Msg("ignoring datachannel: closed by peer")
+			return acceptedStream{}, err
+		} else if err != nil {
+			conn.log.Warn().Err(err).Str("label", lbl).Msg("failed to open datachannel")
+			dc.Close()
+			return acceptedStream{}, err
+		}
+		stream.maxMessageSize = remoteMaxMessageSize(pc)
+		conn.setAddrs(stream, pc, peerPublicKey, target.Port)
+		conn.watchDataChannel(peerPublicKey, lbl, stream.closeCond.C)
+		return acceptedStream{Conn: stream, peerPublicKey: peerPublicKey, target: target}, nil
+	})
+	if !ok {
+		conn.log.Warn().Str("label", lbl).Msg("rejecting datachannel: too many connections waiting to be accepted")
+		dc.Close()
+	}
+}
+
+// acceptPacketChannel queues a data channel opened by the peer to be accepted
+// as a packet connection.
+func (conn *Conn) acceptPacketChannel(pc RTCPeerConnection, peerPublicKey crypt.Key, dc RTCDataChannel) {
+	lbl := dc.Label()
+	target, ok := parsePacketLabel(lbl)
+	if !ok {
+		conn.log.Info().Str("label", lbl).Msg("ignoring datachannel")
+		dc.Close()
+		return
+	}
+
+	// see acceptDataChannel
+	packetConn := newPacketChannel(dc)
+	ok = conn.packetConns.add(func() (acceptedPacketConn, error) {
+		err := packetConn.waitOpen()
+		if errors.Is(err, ErrClosedByPeer) {
+			conn.log.Info().Str("label", lbl).Msg("ignoring datachannel: closed by peer")
+			return acceptedPacketConn{}, err
+		} else if err != nil {
+			conn.log.Warn().Err(err).Str("label", lbl).Msg("failed to open datachannel")
+			dc.Close()
+			return acceptedPacketConn{}, err
+		}
+		packetConn.maxMessageSize = remoteMaxMessageSize(pc)
+		packetConn.localAddr, packetConn.remoteAddr = conn.addrs(dc, pc, peerPublicKey, target.Port)
+		conn.watchDataChannel(peerPublicKey, lbl, packetConn.closeCond.C)
+		return acceptedPacketConn{PacketConn: packetConn, peerPublicKey: peerPublicKey, target: target}, nil
+	})
+	if !ok {
+		conn.log.Warn().Str("label", lbl).Msg("rejecting datachannel: too many packet connections waiting to be accepted")
+		dc.Close()
+	}
+}
+
+// acceptStream queues a multiplexed stream opened by the peer to be accepted.
+// It returns false if the stream is rejected.
+func (conn *Conn) acceptStream(l *link, stream *muxStream) bool {
+	target, ok := parseStreamLabel(stream.label)
+	if !ok {
+		conn.log.Info().Str("label", stream.label).Msg("ignoring stream")
+		return false
+	}
+	conn.setStreamAddrs(stream, l, target.Port)
+
+	ok = conn.streams.add(func() (acceptedStream, error) {
+		return acceptedStream{Conn: stream, peerPublicKey: l.peerPublicKey, target: target}, nil
+	})
+	if !ok {
+		conn.log.Warn().Str("label", stream.label).Msg("rejecting stream: too many connections waiting to be accepted")
+	}
+	return ok
+}
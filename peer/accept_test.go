@@ -0,0 +1,106 @@
+package peer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCloser struct {
+	name   string
+	closed chan struct{}
+}
+
+func newTestCloser(name string) *testCloser {
+	return &testCloser{name: name, closed: make(chan struct{})}
+}
+
+func (c *testCloser) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestAcceptQueue(t *testing.T) {
+	t.Run("CompletionOrder", func(t *testing.T) {
+		q := newAcceptQueue[*testCloser](2)
+
+		unblock := make(chan struct{})
+		slow, fast := newTestCloser("slow"), newTestCloser("fast")
+		assert.True(t, q.add(func() (*testCloser, error) {
+			<-unblock
+			return slow, nil
+		}))
+		assert.True(t, q.add(func() (*testCloser, error) {
+			return fast, nil
+		}))
+
+		// the slow connection doesn't hold up the fast one
+		select {
+		case c := <-q.ready:
+			assert.Equal(t, "fast", c.name)
+			q.accepted()
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for connection")
+		}
+
+		close(unblock)
+		assert.Equal(t, "slow", (<-q.ready).name)
+		q.accepted()
+	})
+
+	t.Run("Backlog", func(t *testing.T) {
+		q := newAcceptQueue[*testCloser](1)
+
+		unblock := make(chan struct{})
+		assert.True(t, q.add(func() (*testCloser, error) {
+			<-unblock
+			return nil, errors.New("failed to open")
+		}))
+		// connections still opening count towards the backlog
+		assert.False(t, q.add(func() (*testCloser, error) {
+			return newTestCloser("rejected"), nil
+		}))
+
+		// a failed open frees its slot
+		close(unblock)
+		assert.Eventually(t, func() bool {
+			return q.add(func() (*testCloser, error) {
+				return newTestCloser("accepted"), nil
+			})
+		}, time.Second, time.Millisecond)
+		c := <-q.ready
+		q.accepted()
+		assert.Equal(t, "accepted", c.name)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		q := newAcceptQueue[*testCloser](1)
+		c := newTestCloser("waiting")
+		assert.True(t, q.add(func() (*testCloser, error) {
+			return c, nil
+		}))
+		assert.Eventually(t, func() bool {
+			return len(q.ready) == 1
+		}, time.Second, time.Millisecond)
+
+		q.close()
+		select {
+		case <-c.closed:
+		default:
+			t.Fatal("expected waiting connection to be closed")
+		}
+
+		// connections which finish opening after close are closed too
+		late := newTestCloser("late")
+		assert.True(t, q.add(func() (*testCloser, error) {
+			return late, nil
+		}))
+		select {
+		case <-late.closed:
+		case <-time.After(time.Second):
+			t.Fatal("expected late connection to be closed")
+		}
+	})
+}
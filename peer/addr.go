@@ -0,0 +1,89 @@
+package peer
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+)
+
+// An Addr is the address of one end of a tunneled connection.
+type Addr struct {
+	// PublicKey is the key of the peer at this end of the connection
+	PublicKey crypt.Key
+	// Label is the label of the data channel, for example "rtctunnel:9000"
+	Label string
+	// Port is the port the connection was opened for
+	Port int
+	// DataChannelID is the id of the data channel, or -1 if it isn't known
+	DataChannelID int
+	// StreamID is the id of the stream within the data channel when streams
+	// are multiplexed, or 0 otherwise
+	StreamID uint32
+	// Candidate is the selected ICE candidate at this end of the connection,
+	// or nil if it isn't known
+	Candidate *CandidateAddr
+}
+
+// newAddr returns the address of one end of a data channel.
+func newAddr(dc RTCDataChannel, publicKey crypt.Key, port int) *Addr {
+	addr := &Addr{
+		PublicKey:     publicKey,
+		Label:         dc.Label(),
+		Port:          port,
+		DataChannelID: -1,
+	}
+	if id, ok := dc.ID(); ok {
+		addr.DataChannelID = int(id)
+	}
+	return addr
+}
+
+// Network returns "webrtc".
+func (addr *Addr) Network() string {
+	return "webrtc"
+}
+
+// String returns the address as webrtc://<public key>/<label>#<data channel id>,
+// followed by /<stream id> for multiplexed streams.
+func (addr *Addr) String() string {
+	s := "webrtc://"
+	if addr.PublicKey != (crypt.Key{}) {
+		s += addr.PublicKey.String()
+	}
+	s += "/" + addr.Label
+	if addr.DataChannelID >= 0 {
+		s += "#" + strconv.Itoa(addr.DataChannelID)
+	}
+	if addr.StreamID != 0 {
+		s += "/" + strconv.FormatUint(uint64(addr.StreamID), 10)
+	}
+	return s
+}
+
+// A CandidateAddr is the transport address of an ICE candidate.
+type CandidateAddr struct {
+	// Protocol is "udp" or "tcp"
+	Protocol string
+	// Address is the IP address, or a hostname for obfuscated host candidates
+	Address string
+	Port    int
+	// Type is "host", "srflx", "prflx" or "relay"
+	Type string
+}
+
+// IP returns the IP address of the candidate, or nil if the address isn't an IP
+// address.
+func (addr *CandidateAddr) IP() net.IP {
+	return net.ParseIP(addr.Address)
+}
+
+// Network returns the protocol of the candidate.
+func (addr *CandidateAddr) Network() string {
+	return addr.Protocol
+}
+
+// String returns the host and port of the candidate.
+func (addr *CandidateAddr) String() string {
+	return net.JoinHostPort(addr.Address, strconv.Itoa(addr.Port))
+}
@@ -0,0 +1,28 @@
+package peer
+
+import (
+	"testing"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddr(t *testing.T) {
+	key := crypt.GenerateKeyPair().Public
+
+	addr := &Addr{PublicKey: key, Label: "rtctunnel:9000", Port: 9000, DataChannelID: 3}
+	assert.Equal(t, "webrtc", addr.Network())
+	assert.Equal(t, "webrtc://"+key.String()+"/rtctunnel:9000#3", addr.String())
+
+	addr.StreamID = 7
+	assert.Equal(t, "webrtc://"+key.String()+"/rtctunnel:9000#3/7", addr.String())
+
+	addr = &Addr{Label: "rtctunnel:9000", DataChannelID: -1}
+	assert.Equal(t, "webrtc:///rtctunnel:9000", addr.String())
+
+	candidate := &CandidateAddr{Protocol: "udp", Address: "2001:db8::1", Port: 5000, Type: "host"}
+	assert.Equal(t, "udp", candidate.Network())
+	assert.Equal(t, "[2001:db8::1]:5000", candidate.String())
+	assert.NotNil(t, candidate.IP())
+	assert.Nil(t, (&CandidateAddr{Address: "abc.local"}).IP())
+}
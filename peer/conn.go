@@ -5,83 +5,297 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 	"github.com/rtctunnel/rtctunnel/crypt"
 	"github.com/rtctunnel/rtctunnel/signal"
 )
 
+const (
+	minReconnectBackoff = time.Second
+	maxReconnectBackoff = time.Minute
+)
+
+var errHandshakeTimeout = errors.New("handshake timed out")
+
+// A link is an established connection to a peer.
+type link struct {
+	pc            RTCPeerConnection
+	peerPublicKey crypt.Key
+	// mux is set when streams are multiplexed over a single data channel
+	mux *muxSession
+}
+
+func (l *link) close() error {
+	if l.mux != nil {
+		_ = l.mux.Close()
+	}
+	return l.pc.Close()
+}
+
 // Conn wraps an RTCPeerConnection so connections can be made and accepted.
+//
+// When the RTCPeerConnection fails, the signaling handshake is run again and
+// the new RTCPeerConnection replaces the old one. Open and Accept wait while
+// reconnecting. Streams opened on the old RTCPeerConnection are closed. These
+// state changes are reported by Events.
 type Conn struct {
-	keypair       crypt.KeyPair
-	peerPublicKey crypt.Key
+	keypair crypt.KeyPair
+	dial    func(ctx context.Context) (*link, error)
+	log     zerolog.Logger
 
-	pc RTCPeerConnection
+	mu            sync.Mutex
+	link          *link
+	peerPublicKey crypt.Key
+	ready         *Cond
+	closed        bool
 
 	closeCond *Cond
 	closeErr  error
 
-	incoming chan RTCDataChannel
+	// peerPostQuantumKeys are the post-quantum keys of the peers, configured
+	// or learned from their signal messages
+	pqMu                sync.Mutex
+	peerPostQuantumKeys map[crypt.Key]crypt.PostQuantumKey
+
+	eventsMu     sync.Mutex
+	subscribers  map[chan Event]struct{}
+	eventsClosed bool
+
+	streams     *acceptQueue[acceptedStream]
+	packetConns *acceptQueue[acceptedPacketConn]
+}
+
+func newConn(keypair crypt.KeyPair, cfg *dialConfig) *Conn {
+	conn := &Conn{
+		keypair: keypair,
+		log:     cfg.logger,
+
+		ready: NewCond(),
+
+		closeCond: NewCond(),
+
+		peerPostQuantumKeys: make(map[crypt.Key]crypt.PostQuantumKey),
+
+		streams:     newAcceptQueue[acceptedStream](cfg.acceptBacklog),
+		packetConns: newAcceptQueue[acceptedPacketConn](cfg.acceptBacklog),
+	}
+	for peerPublicKey, key := range cfg.peerPostQuantumKeys {
+		conn.peerPostQuantumKeys[peerPublicKey] = key
+	}
+	return conn
 }
 
-// Accept accepts a new connection over the datachannel.
+// Accept accepts a new connection over the datachannel. It's AcceptTarget for
+// callers which only use ports; streams opened to a service have port 0.
 func (conn *Conn) Accept() (stream net.Conn, port int, err error) {
-	for dc := range conn.incoming {
-		lbl := dc.Label()
-		idx := strings.LastIndexByte(lbl, ':')
-		if idx < 0 {
-			log.Info().Str("label", lbl).Msg("ignoring datachannel")
-			continue
-		}
-		name := lbl[:idx]
-		port, err := strconv.Atoi(lbl[idx+1:])
-		if err != nil || name != "rtctunnel" {
-			log.Info().Str("label", lbl).Msg("ignoring datachannel")
-			continue
-		}
+	stream, target, err := conn.AcceptTarget()
+	return stream, target.Port, err
+}
 
-		stream, err := WrapDataChannel(dc)
-		if errors.Is(err, ErrClosedByPeer) {
-			log.Info().Str("label", lbl).Msg("ignoring datachannel: closed by peer")
-			continue
-		} else if err != nil {
-			dc.Close()
-			return nil, 0, err
-		}
+// AcceptTarget accepts a new connection over the datachannel, opened by the
+// peer with Open or OpenTarget.
+func (conn *Conn) AcceptTarget() (stream net.Conn, target Target, err error) {
+	select {
+	case accepted := <-conn.streams.ready:
+		conn.streams.accepted()
 
-		log.Info().
-			Str("peer", conn.peerPublicKey.String()).
-			Int("port", port).
+		conn.log.Info().
+			Str("peer", accepted.peerPublicKey.String()).
+			Stringer("target", accepted.target).
+			Stringer("remote", accepted.RemoteAddr()).
 			Msg("accepted connection")
 
-		return stream, port, nil
+		return accepted.Conn, accepted.target, nil
+	case <-conn.closeCond.C:
+		return nil, Target{}, context.Canceled
 	}
-	return nil, 0, context.Canceled
+}
+
+// AcceptPacket accepts a new packet connection opened by the peer with
+// OpenPacket. It's AcceptPacketTarget for callers which only use ports.
+func (conn *Conn) AcceptPacket() (packetConn net.PacketConn, port int, err error) {
+	packetConn, target, err := conn.AcceptPacketTarget()
+	return packetConn, target.Port, err
+}
+
+// AcceptPacketTarget accepts a new packet connection opened by the peer with
+// OpenPacket or OpenPacketTarget.
+func (conn *Conn) AcceptPacketTarget() (packetConn net.PacketConn, target Target, err error) {
+	select {
+	case accepted := <-conn.packetConns.ready:
+		conn.packetConns.accepted()
+
+		conn.log.Info().
+			Str("peer", accepted.peerPublicKey.String()).
+			Stringer("target", accepted.target).
+			Msg("accepted packet connection")
+
+		return accepted.PacketConn, accepted.target, nil
+	case <-conn.closeCond.C:
+		return nil, Target{}, context.Canceled
+	}
+}
+
+// OpenPacket opens a new packet connection to the peer, which accepts it with
+// AcceptPacket. Packets are unordered and aren't retransmitted, which can be
+// changed with options.
+func (conn *Conn) OpenPacket(port int, options ...DataChannelOption) (packetConn net.PacketConn, err error) {
+	return conn.openPacket(fmt.Sprintf("%s%d", packetLabelPrefix, port), Target{Protocol: ProtocolUDP, Port: port}, options...)
+}
+
+// OpenPacketTarget opens a new packet connection to a target, like
+// OpenPacket. The peer must support targets, older peers ignore it.
+func (conn *Conn) OpenPacketTarget(target Target, options ...DataChannelOption) (packetConn net.PacketConn, err error) {
+	if err := target.validate(); err != nil {
+		return nil, err
+	}
+	return conn.openPacket(target.label(packetLabelPrefix), target, options...)
+}
+
+func (conn *Conn) openPacket(label string, target Target, options ...DataChannelOption) (packetConn net.PacketConn, err error) {
+	l, err := conn.current()
+	if err != nil {
+		return nil, err
+	}
+
+	options = append([]DataChannelOption{
+		WithDataChannelOrdered(false),
+		WithDataChannelMaxRetransmits(0),
+	}, options...)
+	dc, err := l.pc.CreateDataChannel(label, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open RTCDataChannel: %w", err)
+	}
+
+	pc, err := WrapPacketChannel(dc)
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	pc.maxMessageSize = remoteMaxMessageSize(l.pc)
+	pc.localAddr, pc.remoteAddr = conn.addrs(dc, l.pc, l.peerPublicKey, target.Port)
+	conn.watchDataChannel(l.peerPublicKey, dc.Label(), pc.closeCond.C)
+
+	conn.log.Info().
+		Str("peer", l.peerPublicKey.String()).
+		Stringer("target", target).
+		Msg("opened packet connection")
+
+	return pc, nil
 }
 
 // Open opens a new connection over the datachannel.
 func (conn *Conn) Open(port int) (stream net.Conn, err error) {
-	dc, err := conn.pc.CreateDataChannel(fmt.Sprintf("rtctunnel:%d", port))
+	return conn.openStream(fmt.Sprintf("rtctunnel:%d", port), Target{Port: port})
+}
+
+// OpenTarget opens a new connection over the datachannel to a target, which
+// the peer accepts with AcceptTarget. The peer must support targets, older
+// peers ignore it.
+func (conn *Conn) OpenTarget(target Target) (stream net.Conn, err error) {
+	if err := target.validate(); err != nil {
+		return nil, err
+	}
+	return conn.openStream(target.label(targetLabelPrefix), target)
+}
+
+func (conn *Conn) openStream(label string, target Target) (stream net.Conn, err error) {
+	l, err := conn.current()
+	if err != nil {
+		return nil, err
+	}
+	pc, peerPublicKey := l.pc, l.peerPublicKey
+
+	if l.mux != nil {
+		stream, err := l.mux.open(label)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open stream: %w", err)
+		}
+		conn.setStreamAddrs(stream, l, target.Port)
+
+		conn.log.Info().
+			Str("peer", peerPublicKey.String()).
+			Stringer("target", target).
+			Msg("opened connection")
+
+		return stream, nil
+	}
+
+	dc, err := pc.CreateDataChannel(label)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open RTCDataChannel: %w", err)
 	}
 
-	stream, err = WrapDataChannel(dc)
+	dataChannel, err := WrapDataChannel(dc)
 	if err != nil {
 		dc.Close()
 		return nil, err
 	}
+	dataChannel.maxMessageSize = remoteMaxMessageSize(pc)
+	conn.setAddrs(dataChannel, pc, peerPublicKey, target.Port)
+	conn.watchDataChannel(peerPublicKey, dc.Label(), dataChannel.closeCond.C)
 
-	log.Info().
-		Str("peer", conn.peerPublicKey.String()).
-		Int("port", port).
+	conn.log.Info().
+		Str("peer", peerPublicKey.String()).
+		Stringer("target", target).
 		Msg("opened connection")
 
-	return stream, err
+	return dataChannel, nil
+}
+
+// setAddrs sets the addresses of a stream opened on pc.
+func (conn *Conn) setAddrs(stream *DataChannel, pc RTCPeerConnection, peerPublicKey crypt.Key, port int) {
+	stream.localAddr, stream.remoteAddr = conn.addrs(stream.dc, pc, peerPublicKey, port)
+}
+
+// addrs returns the addresses of both ends of a data channel opened on pc.
+func (conn *Conn) addrs(dc RTCDataChannel, pc RTCPeerConnection, peerPublicKey crypt.Key, port int) (local, remote *Addr) {
+	local = newAddr(dc, conn.keypair.Public, port)
+	remote = newAddr(dc, peerPublicKey, port)
+
+	localCandidate, remoteCandidate, err := pc.SelectedCandidatePair()
+	if err != nil {
+		conn.log.Debug().Err(err).Msg("failed to get selected candidate pair")
+		return local, remote
+	}
+	local.Candidate = localCandidate
+	remote.Candidate = remoteCandidate
+	return local, remote
+}
+
+// setStreamAddrs sets the addresses of a multiplexed stream.
+func (conn *Conn) setStreamAddrs(stream *muxStream, l *link, port int) {
+	dc := l.mux.conn.(*DataChannel)
+	local, remote := *dc.localAddr, *dc.remoteAddr
+	local.Label, remote.Label = stream.label, stream.label
+	local.Port, remote.Port = port, port
+	local.StreamID, remote.StreamID = stream.id, stream.id
+	stream.localAddr, stream.remoteAddr = &local, &remote
+}
+
+// SelectedCandidatePair returns the local and remote ICE candidates currently
+// used to reach the peer. It waits while reconnecting.
+func (conn *Conn) SelectedCandidatePair() (local, remote *CandidateAddr, err error) {
+	l, err := conn.current()
+	if err != nil {
+		return nil, nil, err
+	}
+	return l.pc.SelectedCandidatePair()
+}
+
+// PeerPublicKey returns the public key of the connected peer. For identities
+// this is the key of the device currently connected.
+func (conn *Conn) PeerPublicKey() crypt.Key {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.peerPublicKey
 }
 
 // Close closes the peer connection
@@ -91,12 +305,21 @@ func (conn *Conn) Close() error {
 
 func (conn *Conn) closeWithError(err error) error {
 	conn.closeCond.Do(func() {
-		if conn.pc != nil {
-			e := conn.pc.Close()
+		conn.mu.Lock()
+		l := conn.link
+		conn.link = nil
+		conn.closed = true
+		conn.mu.Unlock()
+
+		if l != nil {
+			e := l.close()
 			if err == nil {
 				err = e
 			}
 		}
+		conn.streams.close()
+		conn.packetConns.close()
+		conn.emit(Event{Type: EventClosed, PeerPublicKey: conn.PeerPublicKey(), Err: context.Canceled})
 	})
 	if conn.closeErr != nil {
 		err = conn.closeErr
@@ -104,150 +327,586 @@ func (conn *Conn) closeWithError(err error) error {
 	return err
 }
 
-// Open opens a new Connection.
-func Open(keypair crypt.KeyPair, peerPublicKey crypt.Key, options ...signal.Option) (*Conn, error) {
-	conn := &Conn{
-		keypair:       keypair,
-		peerPublicKey: peerPublicKey,
+// current returns the current link, waiting for it if the connection is being
+// re-established.
+func (conn *Conn) current() (*link, error) {
+	for {
+		conn.mu.Lock()
+		l, ready, closed := conn.link, conn.ready, conn.closed
+		conn.mu.Unlock()
 
-		closeCond: NewCond(),
+		if closed {
+			return nil, context.Canceled
+		}
+		if l != nil {
+			return l, nil
+		}
+
+		select {
+		case <-ready.C:
+		case <-conn.closeCond.C:
+		}
+	}
+}
+
+// connect dials the peer and installs the new RTCPeerConnection.
+func (conn *Conn) connect(ctx context.Context) error {
+	l, err := conn.dial(ctx)
+	if err != nil {
+		return err
+	}
+
+	conn.mu.Lock()
+	closed := conn.closed
+	if !closed {
+		conn.link = l
+		conn.peerPublicKey = l.peerPublicKey
+		conn.ready.Signal()
+	}
+	conn.mu.Unlock()
+
+	if closed {
+		_ = l.close()
+		return context.Canceled
+	}
+	conn.emit(Event{Type: EventConnected, PeerPublicKey: l.peerPublicKey})
+	return nil
+}
+
+// isCurrent returns whether pc is the RTCPeerConnection in use.
+func (conn *Conn) isCurrent(pc RTCPeerConnection) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.link != nil && conn.link.pc == pc
+}
+
+// fail is called when an RTCPeerConnection fails. If it's the current one it
+// is replaced by a new connection.
+func (conn *Conn) fail(pc RTCPeerConnection) {
+	conn.mu.Lock()
+	if conn.closed || conn.link == nil || conn.link.pc != pc {
+		conn.mu.Unlock()
+		return
+	}
+	l := conn.link
+	conn.link = nil
+	conn.ready = NewCond()
+	conn.mu.Unlock()
+	peerPublicKey := l.peerPublicKey
+
+	conn.log.Warn().
+		Str("peer", peerPublicKey.String()).
+		Msg("webrtc peer connection failed, reconnecting")
+	conn.emit(Event{Type: EventFailed, PeerPublicKey: peerPublicKey})
+
+	go func() {
+		_ = l.close()
+		conn.reconnect()
+	}()
+}
+
+// reconnect re-establishes the connection, backing off exponentially between
+// attempts, until it succeeds or the connection is closed.
+func (conn *Conn) reconnect() {
+	backoff := minReconnectBackoff
+	for {
+		err := conn.connect(context.Background())
+		if err == nil {
+			conn.log.Info().
+				Str("peer", conn.PeerPublicKey().String()).
+				Msg("reconnected")
+			return
+		} else if errors.Is(err, context.Canceled) {
+			return
+		}
+
+		conn.log.Warn().Err(err).
+			Dur("backoff", backoff).
+			Msg("failed to reconnect")
+
+		select {
+		case <-time.After(backoff):
+		case <-conn.closeCond.C:
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+}
+
+// Open opens a new Connection. Signal messages use hybrid encryption once the
+// peer's post-quantum key is learned from its first message. If it's already
+// known, set it with WithPeerPostQuantumKey so the offer uses it too.
+func Open(keypair crypt.KeyPair, peerPublicKey crypt.Key, options ...DialOption) (*Conn, error) {
+	cfg := getDialConfig(options...)
 
-		incoming: make(chan RTCDataChannel, 1),
+	conn := newConn(keypair, cfg)
+	conn.dial = func(ctx context.Context) (*link, error) {
+		return conn.handshake(ctx, peerPublicKey, cfg)
+	}
+	err := conn.open(cfg.ctx)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// open makes the first connection. The connection is closed if the context is
+// canceled before it's ready.
+func (conn *Conn) open(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	err := conn.connect(ctx)
+	if !stop() {
+		err = ctx.Err()
 	}
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	return nil
+}
+
+// handshake creates a new RTCPeerConnection and runs the signaling handshake
+// with the peer. If both peers support it, a data channel for multiplexed
+// streams is opened too.
+func (conn *Conn) handshake(ctx context.Context, peerPublicKey crypt.Key, cfg *dialConfig) (*link, error) {
+	keypair := conn.keypair
+	options := cfg.signalOptions
 
-	log.Info().
+	conn.log.Info().
 		Str("peer", peerPublicKey.String()).
 		Msg("creating webrtc peer connection")
 
 	connected := NewCond()
+	offerer := keypair.Public.String() < peerPublicKey.String()
+	var multiplex bool
+	muxc := make(chan RTCDataChannel, 1)
 
 	iceReady := NewCond()
 	var iceCandidates []string
 
-	var err error
-	conn.pc, err = NewRTCPeerConnection()
+	pc, err := NewRTCPeerConnection(append(cfg.rtcOptions(), WithCertificateKeyPair(keypair))...)
 	if err != nil {
-		conn.Close()
 		return nil, fmt.Errorf("failed to create webrtc peer connection: %w", err)
 	}
-	conn.pc.OnICECandidate(func(candidate string) {
+	closeWithError := func(err error) error {
+		_ = pc.Close()
+		return err
+	}
+
+	pc.OnICECandidate(func(candidate string) {
 		if candidate == "" {
 			iceReady.Signal()
 		} else {
 			iceCandidates = append(iceCandidates, candidate)
 		}
 	})
-	conn.pc.OnICEConnectionStateChange(func(state string) {
+	pc.OnICEConnectionStateChange(func(state string) {
 		switch state {
+		case "checking":
+			conn.emit(Event{Type: EventChecking, PeerPublicKey: peerPublicKey})
 		case "connected":
+			// the first time, the connected event is sent once the handshake
+			// is done
+			if conn.isCurrent(pc) {
+				conn.emit(Event{Type: EventConnected, PeerPublicKey: peerPublicKey})
+			}
 			connected.Signal()
-		case "closed":
-			_ = conn.closeWithError(context.Canceled)
+		case "disconnected":
+			if conn.isCurrent(pc) {
+				conn.emit(Event{Type: EventDisconnected, PeerPublicKey: peerPublicKey})
+			}
+		case "failed", "closed":
+			conn.fail(pc)
 		}
 	})
-	conn.pc.OnDataChannel(func(dc RTCDataChannel) {
-		conn.incoming <- dc
+	pc.OnDataChannel(func(dc RTCDataChannel) {
+		if dc.Label() == muxLabel {
+			select {
+			case muxc <- dc:
+			default:
+				dc.Close()
+			}
+			return
+		}
+		if strings.HasPrefix(dc.Label(), packetLabelPrefix) {
+			conn.acceptPacketChannel(pc, peerPublicKey, dc)
+			return
+		}
+		conn.acceptDataChannel(pc, peerPublicKey, dc)
 	})
 
-	if keypair.Public.String() < peerPublicKey.String() {
-		_, err := conn.pc.CreateDataChannel("rtctunnel:init")
+	if offerer {
+		_, err := pc.CreateDataChannel("rtctunnel:init")
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error creating init datachannel: %w", err))
+			return nil, closeWithError(fmt.Errorf("error creating init datachannel: %w", err))
 		}
 
 		// we create the offer
-		offer, err := conn.pc.CreateOffer()
+		offer, err := pc.CreateOffer()
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error creating webrtc offer: %w", err))
+			return nil, closeWithError(fmt.Errorf("error creating webrtc offer: %w", err))
 		}
 
 		// wait for the ice candidates
-		select {
-		case <-iceReady.C:
-		case <-conn.closeCond.C:
-			return nil, conn.closeWithError(context.Canceled)
+		err = conn.wait(ctx, iceReady.C, cfg.handshakeTimeout)
+		if err != nil {
+			return nil, closeWithError(fmt.Errorf("error gathering ice candidates: %w", err))
 		}
 
-		err = sendSignal(keypair, peerPublicKey, &SignalMessage{
-			SDP:           offer,
-			ICECandidates: iceCandidates,
+		err = conn.sendSignal(peerPublicKey, &SignalMessage{
+			SDP:                    offer,
+			ICECandidates:          iceCandidates,
+			DTLSFingerprintBinding: bindFingerprint(keypair, peerPublicKey, offer),
+			Multiplex:              cfg.multiplex,
 		}, options...)
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error sending offer: %w", err))
+			return nil, closeWithError(fmt.Errorf("error sending offer: %w", err))
+		}
+
+		answer, err := conn.recvSignal(ctx, peerPublicKey, cfg.handshakeTimeout, options...)
+		if err != nil {
+			return nil, closeWithError(fmt.Errorf("error receiving webrtc answer: %w", err))
 		}
 
-		answer, err := recvSignal(keypair, peerPublicKey, options...)
+		err = conn.verifyFingerprint(peerPublicKey, answer)
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error receiving webrtc answer: %w", err))
+			return nil, closeWithError(fmt.Errorf("error verifying webrtc answer: %w", err))
 		}
+		multiplex = cfg.multiplex && answer.Multiplex
 
-		err = conn.pc.SetAnswer(answer.SDP)
+		err = pc.SetAnswer(answer.SDP)
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error setting webrtc answer: %w", err))
+			return nil, closeWithError(fmt.Errorf("error setting webrtc answer: %w", err))
 		}
 
 		for _, candidate := range answer.ICECandidates {
-			err = conn.pc.AddICECandidate(candidate)
+			err = pc.AddICECandidate(candidate)
 			if err != nil {
-				return nil, conn.closeWithError(fmt.Errorf("error adding ice candidate: %w", err))
+				return nil, closeWithError(fmt.Errorf("error adding ice candidate: %w", err))
 			}
 		}
 
 	} else {
-		offer, err := recvSignal(keypair, peerPublicKey, options...)
+		// waiting for the peer to come online isn't limited by the handshake
+		// timeout
+		offer, err := conn.recvSignal(ctx, peerPublicKey, 0, options...)
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error receiving webrtc offer: %w", err))
+			return nil, closeWithError(fmt.Errorf("error receiving webrtc offer: %w", err))
 		}
 
-		err = conn.pc.SetOffer(offer.SDP)
+		err = conn.verifyFingerprint(peerPublicKey, offer)
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error setting webrtc offer: %w", err))
+			return nil, closeWithError(fmt.Errorf("error verifying webrtc offer: %w", err))
 		}
+		multiplex = cfg.multiplex && offer.Multiplex
 
-		answer, err := conn.pc.CreateAnswer()
+		err = pc.SetOffer(offer.SDP)
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error creating webrtc answer: %w", err))
+			return nil, closeWithError(fmt.Errorf("error setting webrtc offer: %w", err))
+		}
+
+		answer, err := pc.CreateAnswer()
+		if err != nil {
+			return nil, closeWithError(fmt.Errorf("error creating webrtc answer: %w", err))
 		}
 
 		for _, candidate := range offer.ICECandidates {
-			err = conn.pc.AddICECandidate(candidate)
+			err = pc.AddICECandidate(candidate)
 			if err != nil {
-				return nil, conn.closeWithError(fmt.Errorf("error adding ice candidate: %w", err))
+				return nil, closeWithError(fmt.Errorf("error adding ice candidate: %w", err))
 			}
 		}
 
 		// wait for the ice candidates
-		select {
-		case <-iceReady.C:
-		case <-conn.closeCond.C:
-			return nil, conn.closeWithError(context.Canceled)
+		err = conn.wait(ctx, iceReady.C, cfg.handshakeTimeout)
+		if err != nil {
+			return nil, closeWithError(fmt.Errorf("error gathering ice candidates: %w", err))
 		}
 
-		err = sendSignal(keypair, peerPublicKey, &SignalMessage{
-			SDP:           answer,
-			ICECandidates: iceCandidates,
+		err = conn.sendSignal(peerPublicKey, &SignalMessage{
+			SDP:                    answer,
+			ICECandidates:          iceCandidates,
+			DTLSFingerprintBinding: bindFingerprint(keypair, peerPublicKey, answer),
+			Multiplex:              multiplex,
 		}, options...)
 		if err != nil {
-			return nil, conn.closeWithError(fmt.Errorf("error marshaling signal message: %w", err))
+			return nil, closeWithError(fmt.Errorf("error marshaling signal message: %w", err))
 		}
 	}
 
+	err = conn.wait(ctx, connected.C, cfg.handshakeTimeout)
+	if err != nil {
+		return nil, closeWithError(fmt.Errorf("failed to connect: %w", err))
+	}
+
+	l := &link{pc: pc, peerPublicKey: peerPublicKey}
+	if multiplex {
+		l.mux, err = conn.openMux(ctx, l, offerer, muxc, cfg)
+		if err != nil {
+			return nil, closeWithError(fmt.Errorf("failed to open multiplexed data channel: %w", err))
+		}
+	}
+	return l, nil
+}
+
+// openMux opens the data channel used for multiplexed streams. The offerer
+// creates it and the other peer waits for it on muxc.
+func (conn *Conn) openMux(ctx context.Context, l *link, offerer bool, muxc <-chan RTCDataChannel, cfg *dialConfig) (*muxSession, error) {
+	var dc RTCDataChannel
+	if offerer {
+		var err error
+		dc, err = l.pc.CreateDataChannel(muxLabel)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		timer := time.NewTimer(cfg.handshakeTimeout)
+		defer timer.Stop()
+
+		select {
+		case dc = <-muxc:
+		case <-conn.closeCond.C:
+			return nil, context.Canceled
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			return nil, errHandshakeTimeout
+		}
+	}
+
+	stream, err := WrapDataChannel(dc)
+	if err != nil {
+		dc.Close()
+		return nil, err
+	}
+	stream.maxMessageSize = remoteMaxMessageSize(l.pc)
+	conn.setAddrs(stream, l.pc, l.peerPublicKey, 0)
+	conn.watchDataChannel(l.peerPublicKey, muxLabel, stream.closeCond.C)
+
+	return newMuxSession(stream, offerer, func(s *muxStream) bool {
+		return conn.acceptStream(l, s)
+	}, conn.log), nil
+}
+
+// wait waits for c. It fails if the connection is closed, the context is done
+// or the timeout expires.
+func (conn *Conn) wait(ctx context.Context, c <-chan struct{}, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
 	select {
-	case <-time.After(time.Minute):
-		return nil, conn.closeWithError(fmt.Errorf("failed to connect in time: %w", err))
-	case <-connected.C:
+	case <-c:
+		return nil
+	case <-conn.closeCond.C:
+		return context.Canceled
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return errHandshakeTimeout
+	}
+}
+
+// recvSignal receives a signal message from the peer. It stops waiting if the
+// connection is closed, the context is done or the timeout expires. A timeout
+// of 0 waits indefinitely.
+func (conn *Conn) recvSignal(ctx context.Context, peerPublicKey crypt.Key, timeout time.Duration, options ...signal.Option) (*SignalMessage, error) {
+	recvCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if timeout > 0 {
+		var stop context.CancelFunc
+		recvCtx, stop = context.WithTimeoutCause(recvCtx, timeout, errHandshakeTimeout)
+		defer stop()
+	}
+	go func() {
+		select {
+		case <-conn.closeCond.C:
+			cancel(context.Canceled)
+		case <-recvCtx.Done():
+		}
+	}()
+
+	msg, err := conn.recvSignalMessage(recvCtx, peerPublicKey, options...)
+	if err != nil && recvCtx.Err() != nil {
+		return nil, context.Cause(recvCtx)
 	}
+	return msg, err
+}
 
+// OpenIdentity opens a new Connection to a peer with multiple devices. The
+// connection is attempted with every device authorized by the device list and
+// the first device to connect is used. When reconnecting every device is tried
+// again.
+func OpenIdentity(keypair crypt.KeyPair, list crypt.DeviceList, options ...DialOption) (*Conn, error) {
+	err := list.Verify()
+	if err != nil {
+		return nil, err
+	}
+	cfg := getDialConfig(options...)
+
+	conn := newConn(keypair, cfg)
+	conn.dial = func(ctx context.Context) (*link, error) {
+		return conn.handshakeAny(ctx, list, cfg)
+	}
+
+	err = conn.open(cfg.ctx)
+	if err != nil {
+		return nil, err
+	}
 	return conn, nil
 }
 
+// handshakeAny runs the signaling handshake with every device in the list and
+// returns the first link to connect.
+func (conn *Conn) handshakeAny(ctx context.Context, list crypt.DeviceList, cfg *dialConfig) (*link, error) {
+	type result struct {
+		index  int
+		link   *link
+		device crypt.Key
+		err    error
+	}
+	results := make(chan result, len(list.Devices))
+	cancels := make([]context.CancelFunc, len(list.Devices))
+	for i, device := range list.Devices {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		go func(i int, device crypt.Key) {
+			l, err := conn.handshake(attemptCtx, device, cfg)
+			results <- result{index: i, link: l, device: device, err: err}
+		}(i, device)
+	}
+
+	var errs []error
+	for range list.Devices {
+		r := <-results
+		cancels[r.index]()
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+
+		// stop the other handshakes, and close any devices which connected
+		// before they noticed
+		for _, cancel := range cancels {
+			cancel()
+		}
+		remaining := len(list.Devices) - len(errs) - 1
+		go func() {
+			for i := 0; i < remaining; i++ {
+				if r := <-results; r.link != nil {
+					_ = r.link.close()
+				}
+			}
+		}()
+
+		conn.log.Info().
+			Str("identity", list.Identity.String()).
+			Str("device", r.device.String()).
+			Msg("connected to device")
+		return r.link, nil
+	}
+	return nil, fmt.Errorf("failed to connect to any device: %w", errors.Join(errs...))
+}
+
 type SignalMessage struct {
 	SDP           string
 	ICECandidates []string
+	// PostQuantumKey is the sender's post-quantum key. Peers which support it
+	// use hybrid encryption for any messages they send back.
+	PostQuantumKey crypt.PostQuantumKey `json:",omitempty"`
+	// DTLSFingerprintBinding binds the DTLS certificate fingerprint in the SDP
+	// to the sender's key, so a relay can't substitute its own certificate.
+	DTLSFingerprintBinding []byte `json:",omitempty"`
+	// Multiplex is set if the sender supports multiplexed streams. In an
+	// answer it's only set if both peers do.
+	Multiplex bool `json:",omitempty"`
+}
+
+// bindFingerprint returns the binding for the DTLS fingerprint in an SDP, or
+// nil if the SDP doesn't have one.
+func bindFingerprint(keypair crypt.KeyPair, peerPublicKey crypt.Key, sdp string) []byte {
+	fingerprint := sdpFingerprint(sdp)
+	if fingerprint == "" {
+		return nil
+	}
+	return keypair.BindFingerprint(peerPublicKey, fingerprint)
+}
+
+// verifyFingerprint verifies the DTLS fingerprint in the SDP of a signal
+// message matches the binding. Messages without a binding are from older peers
+// and are accepted as is.
+func (conn *Conn) verifyFingerprint(peerPublicKey crypt.Key, msg *SignalMessage) error {
+	if len(msg.DTLSFingerprintBinding) == 0 {
+		conn.log.Warn().
+			Str("peer", peerPublicKey.String()).
+			Msg("peer did not bind its dtls fingerprint")
+		return nil
+	}
+	fingerprint := sdpFingerprint(msg.SDP)
+	if fingerprint == "" {
+		return errors.New("missing or ambiguous dtls fingerprint")
+	}
+	return conn.keypair.VerifyFingerprint(peerPublicKey, fingerprint, msg.DTLSFingerprintBinding)
+}
+
+// remoteMaxMessageSize returns the largest message which can be sent to the
+// peer.
+func remoteMaxMessageSize(pc RTCPeerConnection) int {
+	size := sdpMaxMessageSize(pc.RemoteSDP())
+	if size > maxMessageSize {
+		size = maxMessageSize
+	}
+	return size
 }
 
-func recvSignal(keypair crypt.KeyPair, peerPublicKey crypt.Key, options ...signal.Option) (*SignalMessage, error) {
-	bs, err := signal.Recv(keypair, peerPublicKey, options...)
+// sdpMaxMessageSize returns the max-message-size in an SDP. If it's missing
+// the default is used. 0 means there's no limit.
+func sdpMaxMessageSize(sdp string) int {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		value, ok := strings.CutPrefix(line, "a=max-message-size:")
+		if !ok {
+			continue
+		}
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			break
+		}
+		if size == 0 {
+			return math.MaxInt
+		}
+		return size
+	}
+	return defaultMaxMessageSize
+}
+
+// sdpFingerprint returns the DTLS fingerprint in an SDP, in lowercase. If the
+// SDP has several different fingerprints "" is returned, so a fingerprint can't
+// be smuggled in next to the bound one.
+func sdpFingerprint(sdp string) string {
+	var found string
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		fingerprint, ok := strings.CutPrefix(line, "a=fingerprint:")
+		if !ok {
+			continue
+		}
+		fingerprint = strings.ToLower(fingerprint)
+		if found != "" && found != fingerprint {
+			return ""
+		}
+		found = fingerprint
+	}
+	return found
+}
+
+func (conn *Conn) recvSignalMessage(ctx context.Context, peerPublicKey crypt.Key, options ...signal.Option) (*SignalMessage, error) {
+	bs, err := signal.RecvContext(ctx, conn.keypair, peerPublicKey, options...)
 	if err != nil {
 		return nil, err
 	}
@@ -258,16 +917,31 @@ func recvSignal(keypair crypt.KeyPair, peerPublicKey crypt.Key, options ...signa
 		return nil, err
 	}
 
+	if len(msg.PostQuantumKey) > 0 {
+		conn.pqMu.Lock()
+		conn.peerPostQuantumKeys[peerPublicKey] = msg.PostQuantumKey
+		conn.pqMu.Unlock()
+	}
+
 	return &msg, nil
 }
 
-func sendSignal(keypair crypt.KeyPair, peerPublicKey crypt.Key, msg *SignalMessage, options ...signal.Option) error {
+func (conn *Conn) sendSignal(peerPublicKey crypt.Key, msg *SignalMessage, options ...signal.Option) error {
+	msg.PostQuantumKey = conn.keypair.PostQuantumKey()
+
+	conn.pqMu.Lock()
+	peerPostQuantumKey, ok := conn.peerPostQuantumKeys[peerPublicKey]
+	conn.pqMu.Unlock()
+	if ok {
+		options = append(options[:len(options):len(options)], signal.WithPostQuantumKey(peerPostQuantumKey))
+	}
+
 	bs, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
-	err = signal.Send(keypair, peerPublicKey, bs, options...)
+	err = signal.Send(conn.keypair, peerPublicKey, bs, options...)
 	if err != nil {
 		return err
 	}
@@ -2,20 +2,37 @@ package peer
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"fmt"
 	"io"
+	"math"
+	"net"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rtctunnel/rtctunnel/channels"
 	"github.com/rtctunnel/rtctunnel/crypt"
 	"github.com/rtctunnel/rtctunnel/signal"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/sync/errgroup"
 )
 
 func TestConn(t *testing.T) {
+	t.Run("Callbacks", func(t *testing.T) {
+		testConn(t)
+	})
+	t.Run("Detached", func(t *testing.T) {
+		testConn(t, WithDetachedDataChannels())
+	})
+}
+
+func testConn(t *testing.T, options ...DialOption) {
 	ch, err := channels.Get("memory://test")
 	assert.NoError(t, err)
-	options := []signal.Option{signal.WithChannel(ch)}
+	options = append(options, WithSignalOptions(signal.WithChannel(ch)))
 
 	key1 := crypt.GenerateKeyPair()
 	key2 := crypt.GenerateKeyPair()
@@ -45,6 +62,18 @@ func TestConn(t *testing.T) {
 		defer stream.Close()
 
 		assert.Equal(t, 9000, port)
+		if assert.IsType(t, &Addr{}, stream.RemoteAddr()) {
+			local, remote := stream.LocalAddr().(*Addr), stream.RemoteAddr().(*Addr)
+			assert.Equal(t, key1.Public, local.PublicKey)
+			assert.Equal(t, key2.Public, remote.PublicKey)
+			assert.Equal(t, "rtctunnel:9000", remote.Label)
+			assert.Equal(t, 9000, remote.Port)
+			assert.GreaterOrEqual(t, remote.DataChannelID, 0)
+			assert.Equal(t, local.DataChannelID, remote.DataChannelID)
+			if assert.NotNil(t, remote.Candidate) {
+				assert.NotNil(t, remote.Candidate.IP())
+			}
+		}
 		_, err = io.WriteString(stream, "hello world\n")
 		assert.NoError(t, err)
 		return nil
@@ -69,3 +98,901 @@ func TestConn(t *testing.T) {
 	})
 	assert.NoError(t, eg.Wait())
 }
+
+func TestReconnect(t *testing.T) {
+	ch, err := channels.Get("memory://test-reconnect")
+	assert.NoError(t, err)
+	options := []DialOption{WithSignalOptions(signal.WithChannel(ch))}
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	defer func() {
+		if c1 != nil {
+			c1.Close()
+		}
+		if c2 != nil {
+			c2.Close()
+		}
+	}()
+
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, options...)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+
+	events, unsubscribe := c1.Events()
+	defer unsubscribe()
+
+	// simulate a failure of the underlying connections
+	failed := map[*Conn]RTCPeerConnection{}
+	for _, c := range []*Conn{c1, c2} {
+		l, err := c.current()
+		assert.NoError(t, err)
+		assert.NoError(t, l.pc.Close())
+		failed[c] = l.pc
+	}
+	for c, pc := range failed {
+		assert.Eventually(t, func() bool {
+			next, err := c.current()
+			return err == nil && next.pc != pc
+		}, 30*time.Second, 10*time.Millisecond)
+	}
+	waitEvent(t, events, EventFailed)
+	evt := waitEvent(t, events, EventConnected)
+	assert.Equal(t, key2.Public, evt.PeerPublicKey)
+
+	eg.Go(func() error {
+		stream, port, err := c1.Accept()
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		assert.Equal(t, 9000, port)
+		_, err = io.WriteString(stream, "hello again\n")
+		return err
+	})
+	eg.Go(func() error {
+		stream, err := c2.Open(9000)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		s := bufio.NewScanner(stream)
+		assert.True(t, s.Scan())
+		assert.Equal(t, "hello again", s.Text())
+		return nil
+	})
+	assert.NoError(t, eg.Wait())
+}
+
+func TestConnEvents(t *testing.T) {
+	ch, err := channels.Get("memory://test-events")
+	assert.NoError(t, err)
+	options := []DialOption{WithSignalChannel(ch)}
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, options...)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	defer c2.Close()
+
+	events, _ := c1.Events()
+	assert.NoError(t, c1.Err())
+	select {
+	case <-c1.Done():
+		t.Fatal("should not be done")
+	default:
+	}
+
+	eg.Go(func() error {
+		stream, _, err := c1.Accept()
+		if err != nil {
+			return err
+		}
+		return stream.Close()
+	})
+	stream, err := c2.Open(80)
+	assert.NoError(t, err)
+	defer stream.Close()
+	assert.NoError(t, eg.Wait())
+
+	evt := waitEvent(t, events, EventDataChannelOpened)
+	assert.Equal(t, "rtctunnel:80", evt.Label)
+	assert.Equal(t, key2.Public, evt.PeerPublicKey)
+	evt = waitEvent(t, events, EventDataChannelClosed)
+	assert.Equal(t, "rtctunnel:80", evt.Label)
+
+	assert.NoError(t, c1.Close())
+	evt = waitEvent(t, events, EventClosed)
+	assert.ErrorIs(t, evt.Err, context.Canceled)
+	_, ok := <-events
+	assert.False(t, ok, "events should be closed after the closed event")
+	<-c1.Done()
+	assert.ErrorIs(t, c1.Err(), context.Canceled)
+
+	// subscribing after the conn is closed only gets the closed event
+	events, _ = c1.Events()
+	assert.Equal(t, EventClosed, (<-events).Type)
+	_, ok = <-events
+	assert.False(t, ok)
+}
+
+// waitEvent waits for an event of the given type, skipping any others.
+func waitEvent(t *testing.T, events <-chan Event, typ EventType) Event {
+	t.Helper()
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case evt, ok := <-events:
+			if !ok {
+				t.Fatalf("events closed waiting for %s", typ)
+			}
+			if evt.Type == typ {
+				return evt
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s", typ)
+		}
+	}
+}
+
+func TestOpenContext(t *testing.T) {
+	ch, err := channels.Get("memory://test-context")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	// the peer never answers
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = Open(key2, key1.Public, WithContext(ctx), WithSignalChannel(ch))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestOpenContextNextHandshake(t *testing.T) {
+	ch, err := channels.Get("memory://test-context-next-handshake")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+	if key1.Public.String() > key2.Public.String() {
+		key1, key2 = key2, key1
+	}
+
+	// key2 waits for an offer which never comes
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = Open(key2, key1.Public, WithContext(ctx), WithSignalChannel(ch))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the cancelled handshake mustn't consume the next offer
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var eg errgroup.Group
+	for _, keys := range [][2]crypt.KeyPair{{key1, key2}, {key2, key1}} {
+		eg.Go(func() error {
+			conn, err := Open(keys[0], keys[1].Public, WithContext(ctx), WithSignalChannel(ch))
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		})
+	}
+	assert.NoError(t, eg.Wait())
+}
+
+func TestDialOptions(t *testing.T) {
+	ch, err := channels.Get("memory://test-dial-options")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	open := func(options ...DialOption) error {
+		var eg errgroup.Group
+		for _, keys := range [][2]crypt.KeyPair{{key1, key2}, {key2, key1}} {
+			keys := keys
+			eg.Go(func() error {
+				conn, err := Open(keys[0], keys[1].Public, append(options, WithSignalChannel(ch))...)
+				if err != nil {
+					return err
+				}
+				return conn.Close()
+			})
+		}
+		return eg.Wait()
+	}
+
+	assert.NoError(t, open(WithNetworkTypes(NetworkTypeUDP4)))
+	// there are no TURN servers, so a relay-only connection can't succeed
+	assert.Error(t, open(
+		WithICETransportPolicy(ICETransportPolicyRelay),
+		WithHandshakeTimeout(time.Second),
+	))
+}
+
+func TestOpenIdentity(t *testing.T) {
+	ch, err := channels.Get("memory://test-identity")
+	assert.NoError(t, err)
+	options := []DialOption{WithSignalOptions(signal.WithChannel(ch))}
+
+	key := crypt.GenerateKeyPair()
+	online := crypt.GenerateKeyPair()
+	offline := crypt.GenerateKeyPair()
+	identity := crypt.GenerateIdentityKeyPair()
+	list := identity.SignDeviceList([]crypt.Key{offline.Public, online.Public}, 1)
+
+	var c1, c2 *Conn
+	defer func() {
+		if c1 != nil {
+			c1.Close()
+		}
+		if c2 != nil {
+			c2.Close()
+		}
+	}()
+
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = OpenIdentity(key, list, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(online, key.Public, options...)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	assert.Equal(t, online.Public, c1.PeerPublicKey())
+
+	list.Devices = append(list.Devices, crypt.GenerateKeyPair().Public)
+	_, err = OpenIdentity(key, list, options...)
+	assert.Error(t, err, "should reject a tampered device list")
+}
+
+func TestConnLargeWrite(t *testing.T) {
+	ch, err := channels.Get("memory://test-large-write")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, WithSignalChannel(ch))
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, WithSignalChannel(ch))
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	defer c1.Close()
+	defer c2.Close()
+
+	// much larger than the max message size
+	data := make([]byte, 3*1024*1024+17)
+	_, _ = rand.Read(data)
+
+	// closing discards any data which hasn't been sent yet, so wait for the
+	// reader to finish
+	done := make(chan struct{})
+	eg.Go(func() error {
+		stream, _, err := c1.Accept()
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		_, err = stream.Write(data)
+		<-done
+		return err
+	})
+	eg.Go(func() error {
+		defer close(done)
+
+		stream, err := c2.Open(9000)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		received := make([]byte, len(data))
+		_, err = io.ReadFull(stream, received)
+		assert.Equal(t, data, received)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+}
+
+func TestConnHalfClose(t *testing.T) {
+	t.Run("Callbacks", func(t *testing.T) {
+		testConnHalfClose(t)
+	})
+	t.Run("Detached", func(t *testing.T) {
+		testConnHalfClose(t, WithDetachedDataChannels())
+	})
+}
+
+func testConnHalfClose(t *testing.T, options ...DialOption) {
+	ch, err := channels.Get("memory://test-half-close")
+	assert.NoError(t, err)
+	options = append(options, WithSignalChannel(ch))
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, options...)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	defer c1.Close()
+	defer c2.Close()
+
+	done := make(chan struct{})
+	eg.Go(func() error {
+		stream, _, err := c1.Accept()
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		// read everything until the peer closes its write side, then reply
+		bs, err := io.ReadAll(stream)
+		assert.Equal(t, "ping", string(bs))
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(stream, "pong")
+		if err != nil {
+			return err
+		}
+		err = stream.(*DataChannel).CloseWrite()
+		<-done
+		return err
+	})
+	eg.Go(func() error {
+		defer close(done)
+
+		stream, err := c2.Open(9000)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		_, err = io.WriteString(stream, "ping")
+		if err != nil {
+			return err
+		}
+		err = stream.(*DataChannel).CloseWrite()
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(stream, "more")
+		assert.ErrorIs(t, err, ErrWriteClosed)
+
+		bs, err := io.ReadAll(stream)
+		assert.Equal(t, "pong", string(bs))
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+}
+
+func TestConnMultiplex(t *testing.T) {
+	ch, err := channels.Get("memory://test-multiplex")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	open := func(options1, options2 []DialOption) (c1, c2 *Conn) {
+		var eg errgroup.Group
+		eg.Go(func() error {
+			var err error
+			c1, err = Open(key1, key2.Public, append(options1, WithSignalChannel(ch))...)
+			return err
+		})
+		eg.Go(func() error {
+			var err error
+			c2, err = Open(key2, key1.Public, append(options2, WithSignalChannel(ch))...)
+			return err
+		})
+		assert.NoError(t, eg.Wait())
+		return c1, c2
+	}
+
+	t.Run("Negotiated", func(t *testing.T) {
+		c1, c2 := open([]DialOption{WithMultiplexing()}, []DialOption{WithMultiplexing()})
+		defer c1.Close()
+		defer c2.Close()
+
+		for _, c := range []*Conn{c1, c2} {
+			l, err := c.current()
+			assert.NoError(t, err)
+			assert.NotNil(t, l.mux)
+		}
+
+		// echo every stream
+		go func() {
+			for {
+				stream, port, err := c1.Accept()
+				if err != nil {
+					return
+				}
+				assert.Equal(t, 9000, port)
+				go func() {
+					defer stream.Close()
+					_, _ = io.Copy(stream, stream)
+					_ = stream.(interface{ CloseWrite() error }).CloseWrite()
+				}()
+			}
+		}()
+
+		var eg errgroup.Group
+		for i := 0; i < 20; i++ {
+			i := i
+			eg.Go(func() error {
+				stream, err := c2.Open(9000)
+				if err != nil {
+					return err
+				}
+				defer stream.Close()
+
+				if assert.IsType(t, &Addr{}, stream.RemoteAddr()) {
+					addr := stream.RemoteAddr().(*Addr)
+					assert.Equal(t, key1.Public, addr.PublicKey)
+					assert.Equal(t, 9000, addr.Port)
+					assert.NotZero(t, addr.StreamID)
+				}
+
+				msg := fmt.Sprintf("stream %d", i)
+				_, err = io.WriteString(stream, msg)
+				if err != nil {
+					return err
+				}
+				err = stream.(interface{ CloseWrite() error }).CloseWrite()
+				if err != nil {
+					return err
+				}
+				bs, err := io.ReadAll(stream)
+				assert.Equal(t, msg, string(bs))
+				return err
+			})
+		}
+		assert.NoError(t, eg.Wait())
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		// the peer doesn't support multiplexing, so data channels are used
+		c1, c2 := open([]DialOption{WithMultiplexing()}, nil)
+		defer c1.Close()
+		defer c2.Close()
+
+		l, err := c1.current()
+		assert.NoError(t, err)
+		assert.Nil(t, l.mux)
+
+		var eg errgroup.Group
+		eg.Go(func() error {
+			stream, _, err := c2.Accept()
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			_, err = io.WriteString(stream, "hello world\n")
+			return err
+		})
+		eg.Go(func() error {
+			stream, err := c1.Open(9000)
+			if err != nil {
+				return err
+			}
+			defer stream.Close()
+			assert.IsType(t, &DataChannel{}, stream)
+
+			s := bufio.NewScanner(stream)
+			assert.True(t, s.Scan())
+			assert.Equal(t, "hello world", s.Text())
+			return nil
+		})
+		assert.NoError(t, eg.Wait())
+	})
+}
+
+func TestConnPacket(t *testing.T) {
+	t.Run("Callbacks", func(t *testing.T) {
+		testConnPacket(t)
+	})
+	t.Run("Detached", func(t *testing.T) {
+		testConnPacket(t, WithDetachedDataChannels())
+	})
+}
+
+func testConnPacket(t *testing.T, options ...DialOption) {
+	ch, err := channels.Get("memory://test-packet")
+	assert.NoError(t, err)
+	options = append(options, WithSignalChannel(ch))
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, options...)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	defer c1.Close()
+	defer c2.Close()
+
+	// echo every packet
+	eg.Go(func() error {
+		packetConn, port, err := c1.AcceptPacket()
+		if err != nil {
+			return err
+		}
+		defer packetConn.Close()
+		assert.Equal(t, 53, port)
+
+		buf := make([]byte, 1500)
+		for i := 0; i < 3; i++ {
+			n, addr, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, key2.Public, addr.(*Addr).PublicKey)
+			_, err = packetConn.WriteTo(buf[:n], addr)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	eg.Go(func() error {
+		packetConn, err := c2.OpenPacket(53)
+		if err != nil {
+			return err
+		}
+		defer packetConn.Close()
+
+		buf := make([]byte, 1500)
+		for _, packet := range []string{"one", "two", "three"} {
+			_, err = packetConn.WriteTo([]byte(packet), nil)
+			if err != nil {
+				return err
+			}
+			n, _, err := packetConn.ReadFrom(buf)
+			if err != nil {
+				return err
+			}
+			assert.Equal(t, packet, string(buf[:n]))
+		}
+		return nil
+	})
+	assert.NoError(t, eg.Wait())
+}
+
+func TestConnTarget(t *testing.T) {
+	t.Run("DataChannels", func(t *testing.T) {
+		testConnTarget(t)
+	})
+	t.Run("Multiplexed", func(t *testing.T) {
+		testConnTarget(t, WithMultiplexing())
+	})
+}
+
+func testConnTarget(t *testing.T, options ...DialOption) {
+	ch, err := channels.Get("memory://test-target")
+	assert.NoError(t, err)
+	options = append(options, WithSignalChannel(ch))
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, options...)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	defer c1.Close()
+	defer c2.Close()
+
+	target := Target{
+		Protocol: ProtocolTCP,
+		Service:  "ssh",
+		Metadata: map[string]string{"user": "alice"},
+	}
+	eg.Go(func() error {
+		stream, accepted, err := c1.AcceptTarget()
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+		assert.Equal(t, target, accepted)
+		_, err = io.WriteString(stream, "hello")
+		return err
+	})
+	stream, err := c2.OpenTarget(target)
+	require.NoError(t, err)
+	defer stream.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(stream, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+	assert.NoError(t, eg.Wait())
+
+	// a stream opened by port is still accepted by port
+	eg.Go(func() error {
+		stream, port, err := c1.Accept()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, 22, port)
+		return stream.Close()
+	})
+	stream, err = c2.Open(22)
+	require.NoError(t, err)
+	defer stream.Close()
+	assert.NoError(t, eg.Wait())
+
+	packetTarget := Target{Protocol: ProtocolUDP, Service: "dns"}
+	eg.Go(func() error {
+		packetConn, accepted, err := c1.AcceptPacketTarget()
+		if err != nil {
+			return err
+		}
+		assert.Equal(t, packetTarget, accepted)
+		return packetConn.Close()
+	})
+	packetConn, err := c2.OpenPacketTarget(packetTarget)
+	require.NoError(t, err)
+	defer packetConn.Close()
+	assert.NoError(t, eg.Wait())
+
+	_, err = c2.OpenTarget(Target{Protocol: ProtocolTCP})
+	assert.Error(t, err)
+}
+
+func TestConnStats(t *testing.T) {
+	t.Run("DataChannels", func(t *testing.T) {
+		testConnStats(t)
+	})
+	t.Run("Multiplexed", func(t *testing.T) {
+		testConnStats(t, WithMultiplexing())
+	})
+}
+
+func testConnStats(t *testing.T, options ...DialOption) {
+	ch, err := channels.Get("memory://test-stats")
+	assert.NoError(t, err)
+	options = append(options, WithSignalChannel(ch))
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, options...)
+		return err
+	})
+	assert.NoError(t, eg.Wait())
+	defer c1.Close()
+	defer c2.Close()
+
+	var accepted net.Conn
+	eg.Go(func() error {
+		var err error
+		accepted, _, err = c1.Accept()
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(accepted, make([]byte, 5))
+		return err
+	})
+	stream, err := c2.Open(80)
+	assert.NoError(t, err)
+	defer stream.Close()
+	_, err = stream.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, eg.Wait())
+	defer accepted.Close()
+
+	for _, conn := range []*Conn{c1, c2} {
+		stats, err := conn.Stats()
+		assert.NoError(t, err)
+		assert.NotNil(t, stats.LocalCandidate)
+		assert.NotNil(t, stats.RemoteCandidate)
+		assert.False(t, stats.Relayed())
+		assert.NotZero(t, stats.BytesSent)
+		assert.NotZero(t, stats.BytesReceived)
+		assert.Equal(t, 1, stats.Streams)
+	}
+
+	stats, err := c2.Stats()
+	assert.NoError(t, err)
+	var sent uint64
+	for _, dc := range stats.DataChannels {
+		assert.Equal(t, "open", dc.State)
+		assert.NotEqual(t, -1, dc.ID)
+		sent += dc.BytesSent
+	}
+	assert.GreaterOrEqual(t, sent, uint64(5))
+
+	assert.NoError(t, stream.Close())
+	assert.NoError(t, accepted.Close())
+	assert.Eventually(t, func() bool {
+		stats, err := c2.Stats()
+		return err == nil && stats.Streams == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSDPMaxMessageSize(t *testing.T) {
+	assert.Equal(t, 262144, sdpMaxMessageSize("v=0\r\na=max-message-size:262144\r\n"))
+	assert.Equal(t, defaultMaxMessageSize, sdpMaxMessageSize("v=0\r\n"))
+	assert.Equal(t, math.MaxInt, sdpMaxMessageSize("a=max-message-size:0\r\n"))
+}
+
+func TestSDPFingerprint(t *testing.T) {
+	sdp := "v=0\r\n" +
+		"a=fingerprint:sha-256 AB:CD\r\n" +
+		"m=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\n" +
+		"a=fingerprint:sha-256 ab:cd\r\n"
+	assert.Equal(t, "sha-256 ab:cd", sdpFingerprint(sdp))
+	assert.Equal(t, "", sdpFingerprint(sdp+"a=fingerprint:sha-256 00:00\r\n"))
+	assert.Equal(t, "", sdpFingerprint("v=0\r\n"))
+}
+
+func TestOpenPeerPostQuantumKey(t *testing.T) {
+	ch, err := channels.Get("memory://test-peer-post-quantum-key")
+	assert.NoError(t, err)
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+	if key1.Public.String() > key2.Public.String() {
+		key1, key2 = key2, key1
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := Open(key1, key2.Public, WithSignalOptions(signal.WithChannel(ch)),
+			WithPeerPostQuantumKey(key2.Public, key2.PostQuantumKey()))
+		done <- err
+	}()
+
+	// the offer is the first message, so it can only use hybrid encryption if
+	// the key is configured
+	encoded, err := ch.Recv(key2.Public.String() + "/" + key1.Public.String())
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, "pq1:"))
+
+	// an invalid answer stops the handshake
+	assert.NoError(t, ch.Send(key1.Public.String()+"/"+key2.Public.String(), "invalid"))
+	assert.Error(t, <-done)
+}
+
+func BenchmarkThroughput(b *testing.B) {
+	b.Run("Callbacks", func(b *testing.B) {
+		benchmarkThroughput(b)
+	})
+	b.Run("Detached", func(b *testing.B) {
+		benchmarkThroughput(b, WithDetachedDataChannels())
+	})
+}
+
+func benchmarkThroughput(b *testing.B, options ...DialOption) {
+	ch, err := channels.Get("memory://benchmark-throughput")
+	assert.NoError(b, err)
+	options = append(options, WithSignalChannel(ch))
+
+	key1 := crypt.GenerateKeyPair()
+	key2 := crypt.GenerateKeyPair()
+
+	var c1, c2 *Conn
+	var eg errgroup.Group
+	eg.Go(func() error {
+		var err error
+		c1, err = Open(key1, key2.Public, options...)
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		c2, err = Open(key2, key1.Public, options...)
+		return err
+	})
+	assert.NoError(b, eg.Wait())
+	defer c1.Close()
+	defer c2.Close()
+
+	var src, dst net.Conn
+	eg.Go(func() error {
+		var err error
+		dst, _, err = c1.Accept()
+		return err
+	})
+	eg.Go(func() error {
+		var err error
+		src, err = c2.Open(9000)
+		return err
+	})
+	assert.NoError(b, eg.Wait())
+	defer src.Close()
+	defer dst.Close()
+
+	buf := make([]byte, 32*1024)
+	total := int64(b.N) * int64(len(buf))
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	eg.Go(func() error {
+		_, err := io.CopyN(io.Discard, dst, total)
+		return err
+	})
+	for i := 0; i < b.N; i++ {
+		_, err := src.Write(buf)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	assert.NoError(b, eg.Wait())
+}
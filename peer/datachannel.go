@@ -1,33 +1,78 @@
 package peer
 
 import (
-	"context"
 	"errors"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/crypt"
 )
 
 var ErrClosedByPeer = errors.New("closed by peer")
 
-type dataChannelAddr struct{}
+// ErrWriteClosed is returned when writing after CloseWrite.
+var ErrWriteClosed = errors.New("write side closed")
 
-func (addr dataChannelAddr) Network() string {
-	return "webrtc"
-}
+// Writes block while more than dataChannelHighWaterMark bytes are queued to be
+// sent, until the queue drains to dataChannelLowWaterMark.
+const (
+	dataChannelHighWaterMark = 1024 * 1024
+	dataChannelLowWaterMark  = 256 * 1024
+)
 
-func (addr dataChannelAddr) String() string {
-	return "webrtc://datachannel"
-}
+// defaultMaxMessageSize is the largest message a peer supports when it doesn't
+// say otherwise. RFC 8841 says 65536, but pion doesn't advertise a limit and
+// can only receive 65535 bytes.
+const defaultMaxMessageSize = 65535
 
-// A DataChannel implements the net.Conn interface over a webrtc data channel
+// detachedReadBufferSize is the size of the buffer used to read messages from
+// detached data channels. It must fit the largest message a peer may send.
+const detachedReadBufferSize = 64 * 1024
+
+// A DataChannel implements the net.Conn interface over a webrtc data channel.
+//
+// An empty message marks the end of the stream, like a TCP FIN, so each side
+// can close its write side independently with CloseWrite.
 type DataChannel struct {
 	dc RTCDataChannel
-	rr ContextReadCloser
-	rw ContextWriteCloser
 
+	// detached is set when the data channel is read and written directly
+	detached io.ReadWriteCloser
+
+	readMu sync.Mutex
+	// readQueue holds received messages until they're read. When it's full
+	// OnMessage blocks, which pushes back on the peer.
+	readQueue  [][]byte
+	readQueued int
+	// readChanged is closed and replaced whenever the read state changes
+	readChanged chan struct{}
+	// readBuf and pending are used to read from detached data channels
+	readBuf []byte
+	pending []byte
+	// readEOF is set once the peer closes its write side
+	readEOF      bool
+	readClosed   atomic.Bool
+	readDeadline *deadline
+
+	// writeMu serializes writes, so messages aren't interleaved and the end
+	// of stream marker is sent after any data
+	writeMu     sync.Mutex
+	writeClosed bool
+
+	writeDeadline     *deadline
+	bufferedAmountLow chan struct{}
+	// maxMessageSize is the largest message sent, larger writes are split
+	maxMessageSize int
+
+	localAddr, remoteAddr *Addr
+
+	// opened is set as soon as the data channel opens, before openCond
+	opened    atomic.Bool
 	openCond  *Cond
 	closeCond *Cond
 	closeErr  error
@@ -36,12 +81,27 @@ type DataChannel struct {
 // WrapDataChannel wraps an rtc data channel and implements the net.Conn
 // interface
 func WrapDataChannel(rtcDataChannel RTCDataChannel) (*DataChannel, error) {
-	rr, rw := io.Pipe()
+	dc := newDataChannel(rtcDataChannel)
+	err := dc.waitOpen()
+	if err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
 
+// newDataChannel wraps an rtc data channel without waiting for it to open.
+// The handlers are registered before it returns, so nothing the peer sends is
+// missed.
+func newDataChannel(rtcDataChannel RTCDataChannel) *DataChannel {
 	dc := &DataChannel{
 		dc: rtcDataChannel,
-		rr: ContextReadCloser{Context: context.Background(), ReadCloser: rr},
-		rw: ContextWriteCloser{Context: context.Background(), WriteCloser: rw},
+
+		readChanged:  make(chan struct{}),
+		readDeadline: newDeadline(),
+
+		writeDeadline:     newDeadline(),
+		bufferedAmountLow: make(chan struct{}, 1),
+		maxMessageSize:    defaultMaxMessageSize,
 
 		openCond:  NewCond(),
 		closeCond: NewCond(),
@@ -49,7 +109,22 @@ func WrapDataChannel(rtcDataChannel RTCDataChannel) (*DataChannel, error) {
 	dc.dc.OnClose(func() {
 		_ = dc.closeWithError(ErrClosedByPeer)
 	})
+	dc.dc.SetBufferedAmountLowThreshold(dataChannelLowWaterMark)
+	dc.dc.OnBufferedAmountLow(func() {
+		select {
+		case dc.bufferedAmountLow <- struct{}{}:
+		default:
+		}
+	})
 	dc.dc.OnOpen(func() {
+		dc.opened.Store(true)
+		if detachable, ok := dc.dc.(DetachableRTCDataChannel); ok {
+			// fails if detached data channels aren't enabled, in which case the
+			// callbacks are used
+			if rwc, err := detachable.Detach(); err == nil {
+				dc.detached = rwc
+			}
+		}
 		// for reasons I don't understand, when opened the data channel is not immediately available for use
 		time.Sleep(50 * time.Millisecond)
 		dc.openCond.Signal()
@@ -57,163 +132,311 @@ func WrapDataChannel(rtcDataChannel RTCDataChannel) (*DataChannel, error) {
 	dc.dc.OnMessage(func(data []byte) {
 		log.Debug().Bytes("data", data).
 			Msg("datachannel message")
-
-		if rw != nil {
-			_, err := rw.Write(data)
-			if err != nil {
-				_ = dc.closeWithError(err)
-				rw = nil
-			}
-		}
+		dc.receive(data)
 	})
+	return dc
+}
 
+// waitOpen waits for the data channel to open.
+func (dc *DataChannel) waitOpen() error {
 	select {
 	case <-dc.closeCond.C:
-		err := dc.closeErr
-		if err == nil {
-			err = errors.New("datachannel closed for unknown reasons")
+		if !dc.opened.Load() {
+			err := dc.closeErr
+			if err == nil {
+				err = errors.New("datachannel closed for unknown reasons")
+			}
+			return err
 		}
-		return nil, err
+		// the peer closed it right after it opened, anything it sent before
+		// is still read
+		<-dc.openCond.C
 	case <-dc.openCond.C:
 	}
 
-	return dc, nil
-}
+	dc.localAddr = newAddr(dc.dc, crypt.Key{}, 0)
+	dc.remoteAddr = newAddr(dc.dc, crypt.Key{}, 0)
 
-func (dc *DataChannel) Read(b []byte) (n int, err error) {
-	return dc.rr.Read(b)
+	return nil
 }
 
-func (dc *DataChannel) Write(b []byte) (n int, err error) {
-	err = dc.dc.Send(b)
-	if err != nil {
-		return 0, err
+// receive queues a message received from the peer. It blocks while the queue
+// is full.
+func (dc *DataChannel) receive(data []byte) {
+	dc.readMu.Lock()
+	defer dc.readMu.Unlock()
+
+	for {
+		switch {
+		case dc.readEOF, dc.readClosed.Load(), isClosedChan(dc.closeCond.C):
+			// discard anything after the end of the stream
+			return
+		case len(data) == 0:
+			// the peer closed its write side
+			dc.readEOF = true
+			dc.notifyRead()
+			return
+		case dc.readQueued < dataChannelHighWaterMark:
+			dc.readQueue = append(dc.readQueue, data)
+			dc.readQueued += len(data)
+			dc.notifyRead()
+			return
+		}
+
+		changed := dc.readChanged
+		dc.readMu.Unlock()
+		select {
+		case <-changed:
+		case <-dc.closeCond.C:
+		}
+		dc.readMu.Lock()
 	}
-	return len(b), nil
 }
 
-func (dc *DataChannel) Close() error {
-	return dc.closeWithError(nil)
+// notifyRead wakes up anything waiting for the read state to change. readMu
+// must be held.
+func (dc *DataChannel) notifyRead() {
+	close(dc.readChanged)
+	dc.readChanged = make(chan struct{})
 }
 
-func (dc *DataChannel) LocalAddr() net.Addr {
-	return dataChannelAddr{}
-}
+// Read reads data sent by the peer. Once the peer closes its write side, or
+// the data channel, Read returns io.EOF after everything sent before.
+func (dc *DataChannel) Read(b []byte) (n int, err error) {
+	if dc.detached != nil {
+		return dc.readDetached(b)
+	}
 
-func (dc *DataChannel) RemoteAddr() net.Addr {
-	return dataChannelAddr{}
+	dc.readMu.Lock()
+	defer dc.readMu.Unlock()
+
+	for {
+		if dc.readClosed.Load() || dc.closedLocally() {
+			return 0, net.ErrClosed
+		}
+		if isClosedChan(dc.readDeadline.done()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if len(dc.readQueue) > 0 {
+			n = copy(b, dc.readQueue[0])
+			if n == len(dc.readQueue[0]) {
+				dc.readQueue[0] = nil
+				dc.readQueue = dc.readQueue[1:]
+			} else {
+				dc.readQueue[0] = dc.readQueue[0][n:]
+			}
+			dc.readQueued -= n
+			dc.notifyRead()
+			return n, nil
+		}
+		if dc.readEOF || isClosedChan(dc.closeCond.C) {
+			return 0, io.EOF
+		}
+
+		changed, deadline := dc.readChanged, dc.readDeadline.done()
+		dc.readMu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+		case <-dc.closeCond.C:
+		}
+		dc.readMu.Lock()
+	}
 }
 
-func (dc *DataChannel) SetDeadline(t time.Time) error {
-	var err error
-	if e := dc.SetReadDeadline(t); e != nil {
-		err = e
+// readDetached reads from a detached data channel. Reads return whole
+// messages, so any part of a message which doesn't fit in b is kept for the
+// next Read.
+func (dc *DataChannel) readDetached(b []byte) (n int, err error) {
+	dc.readMu.Lock()
+	defer dc.readMu.Unlock()
+
+	if dc.readClosed.Load() {
+		return 0, net.ErrClosed
 	}
-	if e := dc.SetWriteDeadline(t); e != nil {
-		err = e
+
+	if len(dc.pending) == 0 {
+		if dc.readEOF {
+			return 0, io.EOF
+		}
+
+		buf := b
+		if len(b) < detachedReadBufferSize {
+			if dc.readBuf == nil {
+				dc.readBuf = make([]byte, detachedReadBufferSize)
+			}
+			buf = dc.readBuf
+		}
+		n, err = dc.detached.Read(buf)
+		if err != nil {
+			return 0, err
+		}
+		if n == 0 {
+			// the peer closed its write side
+			dc.readEOF = true
+			return 0, io.EOF
+		}
+		if len(b) >= detachedReadBufferSize {
+			return n, nil
+		}
+		dc.pending = dc.readBuf[:n]
 	}
-	return err
-}
 
-func (dc *DataChannel) SetReadDeadline(t time.Time) error {
-	return dc.rr.SetReadDeadline(t)
+	n = copy(b, dc.pending)
+	dc.pending = dc.pending[n:]
+	return n, nil
 }
 
-func (dc *DataChannel) SetWriteDeadline(t time.Time) error {
-	return dc.rw.SetWriteDeadline(t)
-}
+// Write sends b to the peer. Large writes are split into several messages, no
+// larger than the peer supports. If too much data is queued to be sent, Write
+// blocks until the queue drains or the write deadline passes.
+func (dc *DataChannel) Write(b []byte) (n int, err error) {
+	dc.writeMu.Lock()
+	defer dc.writeMu.Unlock()
 
-func (dc *DataChannel) closeWithError(err error) error {
-	dc.closeCond.Do(func() {
-		e := dc.rr.Close()
-		if err == nil {
-			err = e
+	if dc.writeClosed {
+		return 0, ErrWriteClosed
+	}
+
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > dc.maxMessageSize {
+			chunk = chunk[:dc.maxMessageSize]
 		}
-		e = dc.rw.Close()
-		if err == nil {
-			err = e
+
+		err = dc.waitForBufferedAmountLow()
+		if err != nil {
+			return n, err
 		}
-		e = dc.dc.Close()
-		if err == nil {
-			err = e
+
+		err = dc.send(chunk)
+		if err != nil {
+			return n, err
 		}
-		dc.closeErr = err
-	})
-	return err
-}
 
-type ContextReadCloser struct {
-	context.Context
-	io.ReadCloser
-	cancel func()
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
 }
 
-func (cr ContextReadCloser) Close() error {
-	err := cr.ReadCloser.Close()
-	if cr.cancel != nil {
-		cr.cancel()
-		cr.cancel = nil
+// CloseWrite closes the write side of the data channel. The peer reads
+// io.EOF once it has read everything written before.
+func (dc *DataChannel) CloseWrite() error {
+	dc.writeMu.Lock()
+	defer dc.writeMu.Unlock()
+
+	if dc.writeClosed {
+		return nil
 	}
-	return err
+	dc.writeClosed = true
+	return dc.send(nil)
 }
 
-func (cr ContextReadCloser) SetReadDeadline(t time.Time) error {
-	if cr.cancel != nil {
-		cr.cancel()
-		cr.cancel = nil
+// CloseRead closes the read side of the data channel. Anything the peer sends
+// afterwards is discarded.
+func (dc *DataChannel) CloseRead() error {
+	dc.readClosed.Store(true)
+	if dc.detached != nil {
+		return nil
 	}
-	cr.Context, cr.cancel = context.WithDeadline(context.Background(), t)
+
+	dc.readMu.Lock()
+	defer dc.readMu.Unlock()
+
+	dc.readQueue, dc.readQueued = nil, 0
+	dc.notifyRead()
 	return nil
 }
 
-func (cr ContextReadCloser) Read(p []byte) (n int, err error) {
-	done := make(chan struct{})
-	go func() {
-		n, err = cr.ReadCloser.Read(p)
-		close(done)
-	}()
-	select {
-	case <-done:
-		return n, err
-	case <-cr.Context.Done():
-		return 0, cr.Context.Err()
+func (dc *DataChannel) send(data []byte) error {
+	if dc.detached != nil {
+		_, err := dc.detached.Write(data)
+		return err
 	}
+	return dc.dc.Send(data)
 }
 
-type ContextWriteCloser struct {
-	context.Context
-	io.WriteCloser
-	cancel func()
+// BufferedAmount returns the number of bytes queued to be sent.
+func (dc *DataChannel) BufferedAmount() uint64 {
+	return dc.dc.BufferedAmount()
 }
 
-func (cw ContextWriteCloser) Close() error {
-	err := cw.WriteCloser.Close()
-	if cw.cancel != nil {
-		cw.cancel()
-		cw.cancel = nil
+func (dc *DataChannel) waitForBufferedAmountLow() error {
+	for {
+		select {
+		case <-dc.closeCond.C:
+			return net.ErrClosed
+		case <-dc.writeDeadline.done():
+			return os.ErrDeadlineExceeded
+		default:
+		}
+
+		if dc.dc.BufferedAmount() <= dataChannelHighWaterMark {
+			return nil
+		}
+
+		select {
+		case <-dc.bufferedAmountLow:
+		case <-dc.closeCond.C:
+		case <-dc.writeDeadline.done():
+		}
+	}
+}
+
+func (dc *DataChannel) Close() error {
+	return dc.closeWithError(nil)
+}
+
+// LocalAddr returns the local address, an *Addr.
+func (dc *DataChannel) LocalAddr() net.Addr {
+	return dc.localAddr
+}
+
+// RemoteAddr returns the remote address, an *Addr.
+func (dc *DataChannel) RemoteAddr() net.Addr {
+	return dc.remoteAddr
+}
+
+func (dc *DataChannel) SetDeadline(t time.Time) error {
+	var err error
+	if e := dc.SetReadDeadline(t); e != nil {
+		err = e
+	}
+	if e := dc.SetWriteDeadline(t); e != nil {
+		err = e
 	}
 	return err
 }
 
-func (cw ContextWriteCloser) SetWriteDeadline(t time.Time) error {
-	if cw.cancel != nil {
-		cw.cancel()
-		cw.cancel = nil
+func (dc *DataChannel) SetReadDeadline(t time.Time) error {
+	if rd, ok := dc.detached.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return rd.SetReadDeadline(t)
 	}
-	cw.Context, cw.cancel = context.WithDeadline(context.Background(), t)
+	dc.readDeadline.set(t)
 	return nil
 }
 
-func (cw ContextWriteCloser) Write(p []byte) (n int, err error) {
-	done := make(chan struct{})
-	go func() {
-		n, err = cw.WriteCloser.Write(p)
-		close(done)
-	}()
-	select {
-	case <-done:
-		return n, err
-	case <-cw.Context.Done():
-		return 0, cw.Context.Err()
-	}
+func (dc *DataChannel) SetWriteDeadline(t time.Time) error {
+	dc.writeDeadline.set(t)
+	return nil
+}
+
+// closedLocally returns true if Close was called, rather than the data channel
+// being closed by the peer.
+func (dc *DataChannel) closedLocally() bool {
+	return isClosedChan(dc.closeCond.C) && !errors.Is(dc.closeErr, ErrClosedByPeer)
+}
+
+func (dc *DataChannel) closeWithError(err error) error {
+	dc.closeCond.Do(func() {
+		if err == nil {
+			err = dc.dc.Close()
+		} else {
+			_ = dc.dc.Close()
+		}
+		dc.closeErr = err
+	})
+	return err
 }
@@ -0,0 +1,268 @@
+package peer
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/nettest"
+)
+
+// A fakeRTCDataChannel is an in-memory RTCDataChannel. Sent messages are
+// queued until drain is called.
+type fakeRTCDataChannel struct {
+	mu                  sync.Mutex
+	sent                [][]byte
+	buffered, threshold uint64
+	onBufferedAmountLow func()
+}
+
+func (dc *fakeRTCDataChannel) BufferedAmount() uint64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.buffered
+}
+
+func (dc *fakeRTCDataChannel) Close() error                 { return nil }
+func (dc *fakeRTCDataChannel) ID() (uint16, bool)           { return 1, true }
+func (dc *fakeRTCDataChannel) Label() string                { return "fake" }
+func (dc *fakeRTCDataChannel) OnClose(func())               {}
+func (dc *fakeRTCDataChannel) OnMessage(func([]byte))       {}
+func (dc *fakeRTCDataChannel) OnOpen(handler func())        { go handler() }
+func (dc *fakeRTCDataChannel) OnBufferedAmountLow(f func()) { dc.onBufferedAmountLow = f }
+
+func (dc *fakeRTCDataChannel) Send(data []byte) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.sent = append(dc.sent, append([]byte(nil), data...))
+	dc.buffered += uint64(len(data))
+	return nil
+}
+
+func (dc *fakeRTCDataChannel) SetBufferedAmountLowThreshold(threshold uint64) {
+	dc.threshold = threshold
+}
+
+// drain simulates the queued messages being sent.
+func (dc *fakeRTCDataChannel) drain() {
+	dc.mu.Lock()
+	dc.buffered = 0
+	dc.mu.Unlock()
+	dc.onBufferedAmountLow()
+}
+
+// A memoryRTCDataChannel is one end of an in-memory pair of RTCDataChannels.
+// Sent messages are queued and delivered in order to the other end, which
+// blocks like SCTP does when the other end stops reading.
+type memoryRTCDataChannel struct {
+	peer *memoryRTCDataChannel
+
+	mu                  sync.Mutex
+	cond                *sync.Cond
+	queue               [][]byte
+	buffered, threshold uint64
+	closed              bool
+	onBufferedAmountLow func()
+	onClose             func()
+	onMessage           func([]byte)
+}
+
+func newMemoryRTCDataChannelPair() (dc1, dc2 *memoryRTCDataChannel) {
+	dc1, dc2 = new(memoryRTCDataChannel), new(memoryRTCDataChannel)
+	dc1.peer, dc2.peer = dc2, dc1
+	dc1.cond, dc2.cond = sync.NewCond(&dc1.mu), sync.NewCond(&dc2.mu)
+	return dc1, dc2
+}
+
+func (dc *memoryRTCDataChannel) BufferedAmount() uint64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.buffered
+}
+
+func (dc *memoryRTCDataChannel) Close() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.closed = true
+	dc.cond.Broadcast()
+	return nil
+}
+
+func (dc *memoryRTCDataChannel) ID() (uint16, bool) { return 1, true }
+func (dc *memoryRTCDataChannel) Label() string      { return "memory" }
+
+func (dc *memoryRTCDataChannel) OnBufferedAmountLow(f func()) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.onBufferedAmountLow = f
+}
+
+func (dc *memoryRTCDataChannel) OnClose(f func()) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.onClose = f
+}
+
+func (dc *memoryRTCDataChannel) OnMessage(f func([]byte)) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.onMessage = f
+}
+
+func (dc *memoryRTCDataChannel) OnOpen(handler func()) {
+	go func() {
+		handler()
+		go dc.deliver()
+	}()
+}
+
+func (dc *memoryRTCDataChannel) Send(data []byte) error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	if dc.closed {
+		return errors.New("closed")
+	}
+	dc.queue = append(dc.queue, append([]byte(nil), data...))
+	dc.buffered += uint64(len(data))
+	dc.cond.Broadcast()
+	return nil
+}
+
+func (dc *memoryRTCDataChannel) SetBufferedAmountLowThreshold(threshold uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.threshold = threshold
+}
+
+// deliver delivers queued messages to the peer. Once closed, the rest of the
+// queue is delivered before the peer is told.
+func (dc *memoryRTCDataChannel) deliver() {
+	dc.mu.Lock()
+	for {
+		for len(dc.queue) == 0 && !dc.closed {
+			dc.cond.Wait()
+		}
+		if len(dc.queue) == 0 {
+			break
+		}
+		data := dc.queue[0]
+		dc.queue = dc.queue[1:]
+		dc.mu.Unlock()
+
+		dc.peer.mu.Lock()
+		onMessage := dc.peer.onMessage
+		dc.peer.mu.Unlock()
+		onMessage(data)
+
+		dc.mu.Lock()
+		before := dc.buffered
+		dc.buffered -= uint64(len(data))
+		if before > dc.threshold && dc.buffered <= dc.threshold && dc.onBufferedAmountLow != nil {
+			dc.onBufferedAmountLow()
+		}
+	}
+	dc.mu.Unlock()
+
+	dc.peer.mu.Lock()
+	onClose := dc.peer.onClose
+	dc.peer.mu.Unlock()
+	onClose()
+}
+
+// newMemoryDataChannelPair returns a pair of DataChannels connected in memory.
+func newMemoryDataChannelPair() (dc1, dc2 *DataChannel, err error) {
+	fake1, fake2 := newMemoryRTCDataChannelPair()
+	var err1, err2 error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		dc1, err1 = WrapDataChannel(fake1)
+	}()
+	go func() {
+		defer wg.Done()
+		dc2, err2 = WrapDataChannel(fake2)
+	}()
+	wg.Wait()
+	if err1 != nil {
+		return nil, nil, err1
+	} else if err2 != nil {
+		return nil, nil, err2
+	}
+	return dc1, dc2, nil
+}
+
+func TestDataChannelNetConn(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		dc1, dc2, err := newMemoryDataChannelPair()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return dc1, dc2, func() {
+			_ = dc1.Close()
+			_ = dc2.Close()
+		}, nil
+	})
+}
+
+func TestDataChannelBackpressure(t *testing.T) {
+	fake := new(fakeRTCDataChannel)
+	dc, err := WrapDataChannel(fake)
+	assert.NoError(t, err)
+	defer dc.Close()
+	assert.Equal(t, uint64(dataChannelLowWaterMark), fake.threshold)
+
+	_, err = dc.Write(make([]byte, dataChannelHighWaterMark+1))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(dataChannelHighWaterMark+1), dc.BufferedAmount())
+
+	// the buffer is full, so the write should block until the deadline
+	assert.NoError(t, dc.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+	_, err = dc.Write([]byte("blocked"))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+
+	// and resume once the buffer drains
+	assert.NoError(t, dc.SetWriteDeadline(time.Time{}))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := dc.Write([]byte("resumed"))
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("write should block, got: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	fake.drain()
+	assert.NoError(t, <-errc)
+	assert.Equal(t, []byte("resumed"), fake.sent[len(fake.sent)-1])
+}
+
+func TestDataChannelChunkedWrite(t *testing.T) {
+	fake := new(fakeRTCDataChannel)
+	dc, err := WrapDataChannel(fake)
+	assert.NoError(t, err)
+	defer dc.Close()
+	dc.maxMessageSize = 1000
+
+	data := make([]byte, 2500)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	n, err := dc.Write(data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+
+	var sizes []int
+	var received []byte
+	for _, msg := range fake.sent {
+		sizes = append(sizes, len(msg))
+		received = append(received, msg...)
+	}
+	assert.Equal(t, []int{1000, 1000, 500}, sizes)
+	assert.Equal(t, data, received)
+}
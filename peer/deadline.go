@@ -0,0 +1,71 @@
+package peer
+
+import (
+	"sync"
+	"time"
+)
+
+// A deadline implements a net.Conn deadline. The channel returned by done is
+// closed when the deadline passes. Extending a deadline which hasn't passed
+// yet keeps the same channel, so waiters aren't woken up.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	c     chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{c: make(chan struct{})}
+}
+
+// set sets the deadline. A zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	if isClosedChan(d.c) {
+		d.c = make(chan struct{})
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.c)
+		return
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(dur, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// the deadline may have been changed while the timer was firing
+		if d.timer == timer && !isClosedChan(d.c) {
+			close(d.c)
+		}
+	})
+	d.timer = timer
+}
+
+// done returns a channel which is closed when the deadline passes.
+func (d *deadline) done() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.c
+}
+
+func isClosedChan(c <-chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
@@ -26,10 +26,15 @@ func NewDispatcher(conn *Conn) *Dispatcher {
 		for {
 			conn, port, err := conn.Accept()
 			if err != nil {
+				select {
+				case <-d.conn.Done():
+					return
+				default:
+				}
 				if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
 					time.Sleep(time.Second)
-					continue
 				}
+				continue
 			}
 
 			shouldClose := false
@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"context"
+	"time"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+)
+
+// eventBufferSize is how many events a subscriber can fall behind before
+// events are dropped.
+const eventBufferSize = 64
+
+// An EventType is a kind of Event.
+type EventType string
+
+// EventTypes
+const (
+	// EventChecking is sent when ICE starts checking candidates
+	EventChecking EventType = "checking"
+	// EventConnected is sent when the connection is ready to use, after the
+	// first handshake, after reconnecting, and when ICE recovers after being
+	// disconnected
+	EventConnected EventType = "connected"
+	// EventDisconnected is sent when ICE loses connectivity. It may recover on
+	// its own, otherwise EventFailed follows.
+	EventDisconnected EventType = "disconnected"
+	// EventFailed is sent when the connection fails. It's re-established
+	// until the Conn is closed.
+	EventFailed EventType = "failed"
+	// EventClosed is sent when the Conn is closed. It's the last event.
+	EventClosed EventType = "closed"
+	// EventDataChannelOpened is sent when a data channel opens
+	EventDataChannelOpened EventType = "datachannel-opened"
+	// EventDataChannelClosed is sent when a data channel closes
+	EventDataChannelClosed EventType = "datachannel-closed"
+)
+
+// An Event is a change to the state of a Conn.
+type Event struct {
+	Type EventType
+	Time time.Time
+	// PeerPublicKey is the peer the event is about
+	PeerPublicKey crypt.Key
+	// Label is the data channel label, for data channel events
+	Label string
+	// Err is why the Conn was closed, for EventClosed
+	Err error
+}
+
+// Done returns a channel that's closed when the Conn is closed.
+func (conn *Conn) Done() <-chan struct{} {
+	return conn.closeCond.C
+}
+
+// Err returns nil until the Conn is closed, and then context.Canceled, the
+// same error Open and Accept return once it's closed.
+func (conn *Conn) Err() error {
+	if isClosedChan(conn.closeCond.C) {
+		return context.Canceled
+	}
+	return nil
+}
+
+// Events subscribes to the Conn's events. Events are dropped if they aren't
+// received quickly enough. The channel is closed after EventClosed, or when
+// unsubscribe is called.
+func (conn *Conn) Events() (events <-chan Event, unsubscribe func()) {
+	c := make(chan Event, eventBufferSize)
+
+	conn.eventsMu.Lock()
+	defer conn.eventsMu.Unlock()
+
+	if conn.eventsClosed {
+		c <- Event{Type: EventClosed, Time: time.Now(), PeerPublicKey: conn.PeerPublicKey(), Err: context.Canceled}
+		close(c)
+		return c, func() {}
+	}
+	if conn.subscribers == nil {
+		conn.subscribers = make(map[chan Event]struct{})
+	}
+	conn.subscribers[c] = struct{}{}
+
+	return c, func() {
+		conn.eventsMu.Lock()
+		defer conn.eventsMu.Unlock()
+		if _, ok := conn.subscribers[c]; ok {
+			delete(conn.subscribers, c)
+			close(c)
+		}
+	}
+}
+
+// emit sends an event to every subscriber.
+func (conn *Conn) emit(evt Event) {
+	evt.Time = time.Now()
+
+	conn.eventsMu.Lock()
+	defer conn.eventsMu.Unlock()
+
+	if conn.eventsClosed {
+		return
+	}
+	for c := range conn.subscribers {
+		select {
+		case c <- evt:
+		default:
+		}
+	}
+	if evt.Type == EventClosed {
+		for c := range conn.subscribers {
+			close(c)
+		}
+		conn.subscribers = nil
+		conn.eventsClosed = true
+	}
+}
+
+// watchDataChannel sends the events for a data channel opening, and closing
+// once closed is.
+func (conn *Conn) watchDataChannel(peerPublicKey crypt.Key, label string, closed <-chan struct{}) {
+	conn.emit(Event{Type: EventDataChannelOpened, PeerPublicKey: peerPublicKey, Label: label})
+	go func() {
+		<-closed
+		conn.emit(Event{Type: EventDataChannelClosed, PeerPublicKey: peerPublicKey, Label: label})
+	}()
+}
@@ -0,0 +1,587 @@
+package peer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Streams can be multiplexed over a single data channel, which avoids the round
+// trip and SCTP stream needed to open a data channel for every stream. Each
+// frame starts with a header:
+//
+//	type (1 byte) | stream id (4 bytes) | length (4 bytes)
+//
+// followed by length bytes of payload. Each stream has its own flow control
+// window, so a stream which isn't read doesn't block the others.
+
+// muxLabel is the label of the data channel used for multiplexed streams.
+const muxLabel = "rtctunnel:mux"
+
+const (
+	// muxFrameOpen opens a stream, the payload is its label
+	muxFrameOpen byte = iota + 1
+	// muxFrameData carries stream data
+	muxFrameData
+	// muxFrameWindow grows the send window, the payload is the 4 byte increment
+	muxFrameWindow
+	// muxFrameFin closes the sender's write side
+	muxFrameFin
+	// muxFrameClose closes the stream
+	muxFrameClose
+)
+
+const (
+	muxHeaderSize = 9
+	// muxMaxFrameSize is the largest payload of a frame
+	muxMaxFrameSize = 32 * 1024
+	// muxWindowSize is how much data may be sent on a stream before the peer
+	// reads it
+	muxWindowSize = 256 * 1024
+	// muxMaxQueuedControlFrames is how many control frames may wait to be
+	// sent before the peer is considered misbehaving
+	muxMaxQueuedControlFrames = 1024
+)
+
+var errMuxProtocol = errors.New("mux protocol error")
+
+// A muxSession multiplexes streams over a single connection.
+type muxSession struct {
+	conn   net.Conn
+	log    zerolog.Logger
+	accept func(*muxStream) bool
+
+	writeMu  sync.Mutex
+	writeBuf []byte
+
+	// control holds the frames queued by the read loop, which mustn't block
+	// on writes. They're sent by controlLoop.
+	controlMu    sync.Mutex
+	control      []muxControlFrame
+	controlReady chan struct{}
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	closeCond *Cond
+	closeErr  error
+}
+
+// newMuxSession starts a session over conn. The peers must pass different
+// values for client, so they don't pick the same stream ids. accept is called
+// for each stream the peer opens, and the stream is rejected if it returns
+// false.
+func newMuxSession(conn net.Conn, client bool, accept func(*muxStream) bool, logger zerolog.Logger) *muxSession {
+	s := &muxSession{
+		conn:   conn,
+		log:    logger,
+		accept: accept,
+
+		controlReady: make(chan struct{}, 1),
+
+		streams: make(map[uint32]*muxStream),
+		nextID:  2,
+
+		closeCond: NewCond(),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.readLoop()
+	go s.controlLoop()
+	return s
+}
+
+// A muxControlFrame is a frame without a payload queued by the read loop.
+type muxControlFrame struct {
+	typ byte
+	id  uint32
+}
+
+// open opens a new stream with the given label.
+func (s *muxSession) open(label string) (*muxStream, error) {
+	s.mu.Lock()
+	if s.streams == nil {
+		// the session is closed
+		s.mu.Unlock()
+		return nil, s.err()
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newMuxStream(s, id, label)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	err := s.writeFrame(muxFrameOpen, id, []byte(label))
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Close closes the session and every stream.
+func (s *muxSession) Close() error {
+	return s.closeWithError(net.ErrClosed)
+}
+
+func (s *muxSession) closeWithError(err error) error {
+	s.closeCond.Do(func() {
+		s.closeErr = err
+		_ = s.conn.Close()
+
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = nil
+		s.mu.Unlock()
+
+		for _, stream := range streams {
+			stream.mu.Lock()
+			stream.notify()
+			stream.mu.Unlock()
+		}
+	})
+	return nil
+}
+
+// err returns why the session was closed.
+func (s *muxSession) err() error {
+	switch {
+	case errors.Is(s.closeErr, net.ErrClosed):
+		return net.ErrClosed
+	case errors.Is(s.closeErr, ErrClosedByPeer):
+		return ErrClosedByPeer
+	default:
+		return fmt.Errorf("%w: %v", ErrClosedByPeer, s.closeErr)
+	}
+}
+
+func (s *muxSession) get(id uint32) *muxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *muxSession) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+// numStreams returns the number of streams which aren't fully closed yet.
+func (s *muxSession) numStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	if isClosedChan(s.closeCond.C) {
+		return s.err()
+	}
+
+	s.writeBuf = append(s.writeBuf[:0], typ)
+	s.writeBuf = binary.BigEndian.AppendUint32(s.writeBuf, id)
+	s.writeBuf = binary.BigEndian.AppendUint32(s.writeBuf, uint32(len(payload)))
+	s.writeBuf = append(s.writeBuf, payload...)
+	_, err := s.conn.Write(s.writeBuf)
+	if err != nil {
+		_ = s.closeWithError(err)
+		return s.err()
+	}
+	return nil
+}
+
+// queueControl queues a frame without a payload to be sent by controlLoop. If
+// the read loop blocked on writing it, and the peer did too, neither would
+// read again.
+func (s *muxSession) queueControl(typ byte, id uint32) error {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+
+	if len(s.control) >= muxMaxQueuedControlFrames {
+		return fmt.Errorf("%w: too many queued control frames", errMuxProtocol)
+	}
+	s.control = append(s.control, muxControlFrame{typ: typ, id: id})
+	select {
+	case s.controlReady <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// controlLoop sends the queued control frames until the session is closed.
+func (s *muxSession) controlLoop() {
+	for {
+		select {
+		case <-s.controlReady:
+		case <-s.closeCond.C:
+			return
+		}
+
+		s.controlMu.Lock()
+		frames := s.control
+		s.control = nil
+		s.controlMu.Unlock()
+
+		for _, f := range frames {
+			err := s.writeFrame(f.typ, f.id, nil)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *muxSession) readLoop() {
+	err := s.read()
+	if errors.Is(err, io.EOF) {
+		err = ErrClosedByPeer
+	} else if errors.Is(err, errMuxProtocol) {
+		s.log.Warn().Err(err).Msg("closing multiplexed session")
+	}
+	_ = s.closeWithError(err)
+}
+
+func (s *muxSession) read() error {
+	r := bufio.NewReaderSize(s.conn, detachedReadBufferSize)
+	header := make([]byte, muxHeaderSize)
+	payload := make([]byte, muxMaxFrameSize)
+	for {
+		_, err := io.ReadFull(r, header)
+		if err != nil {
+			return err
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		length := binary.BigEndian.Uint32(header[5:])
+		if length > muxMaxFrameSize {
+			return fmt.Errorf("%w: frame too large: %d", errMuxProtocol, length)
+		}
+		_, err = io.ReadFull(r, payload[:length])
+		if err != nil {
+			return err
+		}
+
+		err = s.handleFrame(typ, id, payload[:length])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *muxSession) handleFrame(typ byte, id uint32, payload []byte) error {
+	if typ == muxFrameOpen {
+		s.mu.Lock()
+		if s.streams == nil {
+			s.mu.Unlock()
+			return nil
+		}
+		if _, ok := s.streams[id]; ok || id%2 == s.nextID%2 {
+			s.mu.Unlock()
+			return fmt.Errorf("%w: invalid stream id: %d", errMuxProtocol, id)
+		}
+		stream := newMuxStream(s, id, string(payload))
+		s.streams[id] = stream
+		s.mu.Unlock()
+
+		if !s.accept(stream) {
+			s.remove(id)
+			return s.queueControl(muxFrameClose, id)
+		}
+		return nil
+	}
+
+	stream := s.get(id)
+	if stream == nil {
+		// the stream was closed, so anything still in flight is dropped
+		return nil
+	}
+
+	switch typ {
+	case muxFrameData:
+		return stream.receive(payload)
+	case muxFrameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("%w: invalid window update", errMuxProtocol)
+		}
+		stream.grow(binary.BigEndian.Uint32(payload))
+	case muxFrameFin:
+		stream.receiveFin()
+	case muxFrameClose:
+		s.remove(id)
+		stream.receiveClose()
+	default:
+		return fmt.Errorf("%w: unknown frame type: %d", errMuxProtocol, typ)
+	}
+	return nil
+}
+
+// A muxStream is a stream multiplexed over a muxSession. It implements the
+// net.Conn interface.
+type muxStream struct {
+	session *muxSession
+	id      uint32
+	label   string
+
+	localAddr, remoteAddr *Addr
+
+	mu sync.Mutex
+	// changed is closed and replaced whenever the state changes
+	changed chan struct{}
+	readBuf bytes.Buffer
+	// unacked is how much has been read without telling the peer
+	unacked      uint32
+	readEOF      bool
+	remoteClosed bool
+	closed       bool
+	sendWindow   uint32
+
+	// writeMu serializes writes, so they aren't interleaved
+	writeMu     sync.Mutex
+	writeClosed bool
+
+	readDeadline, writeDeadline *deadline
+}
+
+func newMuxStream(session *muxSession, id uint32, label string) *muxStream {
+	return &muxStream{
+		session: session,
+		id:      id,
+		label:   label,
+
+		changed:    make(chan struct{}),
+		sendWindow: muxWindowSize,
+
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+	}
+}
+
+// notify wakes up anything waiting for the state to change. mu must be held.
+func (stream *muxStream) notify() {
+	close(stream.changed)
+	stream.changed = make(chan struct{})
+}
+
+func (stream *muxStream) receive(data []byte) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if stream.closed || stream.readEOF {
+		return nil
+	}
+	if stream.readBuf.Len()+len(data) > muxWindowSize {
+		return fmt.Errorf("%w: stream %d exceeded its window", errMuxProtocol, stream.id)
+	}
+	stream.readBuf.Write(data)
+	stream.notify()
+	return nil
+}
+
+func (stream *muxStream) grow(n uint32) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	stream.sendWindow += n
+	stream.notify()
+}
+
+func (stream *muxStream) receiveFin() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	stream.readEOF = true
+	stream.notify()
+}
+
+func (stream *muxStream) receiveClose() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	stream.readEOF = true
+	stream.remoteClosed = true
+	stream.notify()
+}
+
+// Read reads data sent by the peer. Once the peer closes its write side, or
+// the stream, Read returns io.EOF after everything sent before.
+func (stream *muxStream) Read(b []byte) (n int, err error) {
+	stream.mu.Lock()
+	for {
+		if stream.closed {
+			stream.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if isClosedChan(stream.readDeadline.done()) {
+			stream.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+
+		if stream.readBuf.Len() > 0 {
+			n, _ = stream.readBuf.Read(b)
+			stream.unacked += uint32(n)
+			var ack uint32
+			// tell the peer about the free space in batches
+			if stream.unacked >= muxWindowSize/2 {
+				ack, stream.unacked = stream.unacked, 0
+			}
+			stream.mu.Unlock()
+
+			if ack > 0 {
+				_ = stream.session.writeFrame(muxFrameWindow, stream.id, binary.BigEndian.AppendUint32(nil, ack))
+			}
+			return n, nil
+		}
+		if stream.readEOF {
+			stream.mu.Unlock()
+			return 0, io.EOF
+		}
+		if isClosedChan(stream.session.closeCond.C) {
+			stream.mu.Unlock()
+			return 0, stream.session.err()
+		}
+
+		changed, deadline := stream.changed, stream.readDeadline.done()
+		stream.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+		case <-stream.session.closeCond.C:
+		}
+		stream.mu.Lock()
+	}
+}
+
+// Write sends b to the peer. It blocks while the peer's window is full.
+func (stream *muxStream) Write(b []byte) (n int, err error) {
+	stream.writeMu.Lock()
+	defer stream.writeMu.Unlock()
+
+	for len(b) > 0 {
+		size, err := stream.waitForWindow(len(b))
+		if err != nil {
+			return n, err
+		}
+
+		err = stream.session.writeFrame(muxFrameData, stream.id, b[:size])
+		if err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// waitForWindow waits until some of the window is free, and reserves up to
+// size bytes of it.
+func (stream *muxStream) waitForWindow(size int) (int, error) {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	for {
+		switch {
+		case stream.closed:
+			return 0, net.ErrClosed
+		case stream.writeClosed:
+			return 0, ErrWriteClosed
+		case stream.remoteClosed:
+			return 0, ErrClosedByPeer
+		case isClosedChan(stream.session.closeCond.C):
+			return 0, stream.session.err()
+		case isClosedChan(stream.writeDeadline.done()):
+			return 0, os.ErrDeadlineExceeded
+		case stream.sendWindow > 0:
+			size = min(size, muxMaxFrameSize, int(stream.sendWindow))
+			stream.sendWindow -= uint32(size)
+			return size, nil
+		}
+
+		changed, deadline := stream.changed, stream.writeDeadline.done()
+		stream.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+		case <-stream.session.closeCond.C:
+		}
+		stream.mu.Lock()
+	}
+}
+
+// CloseWrite closes the write side of the stream. The peer reads io.EOF once
+// it has read everything written before.
+func (stream *muxStream) CloseWrite() error {
+	stream.writeMu.Lock()
+	defer stream.writeMu.Unlock()
+
+	stream.mu.Lock()
+	if stream.writeClosed || stream.closed {
+		stream.mu.Unlock()
+		return nil
+	}
+	stream.writeClosed = true
+	stream.notify()
+	stream.mu.Unlock()
+
+	return stream.session.writeFrame(muxFrameFin, stream.id, nil)
+}
+
+// Close closes the stream.
+func (stream *muxStream) Close() error {
+	stream.mu.Lock()
+	if stream.closed {
+		stream.mu.Unlock()
+		return nil
+	}
+	stream.closed = true
+	stream.readBuf.Reset()
+	stream.notify()
+	remoteClosed := stream.remoteClosed
+	stream.mu.Unlock()
+
+	stream.session.remove(stream.id)
+	if remoteClosed || isClosedChan(stream.session.closeCond.C) {
+		return nil
+	}
+	return stream.session.writeFrame(muxFrameClose, stream.id, nil)
+}
+
+// LocalAddr returns the local address, an *Addr.
+func (stream *muxStream) LocalAddr() net.Addr {
+	return stream.localAddr
+}
+
+// RemoteAddr returns the remote address, an *Addr.
+func (stream *muxStream) RemoteAddr() net.Addr {
+	return stream.remoteAddr
+}
+
+func (stream *muxStream) SetDeadline(t time.Time) error {
+	stream.readDeadline.set(t)
+	stream.writeDeadline.set(t)
+	return nil
+}
+
+func (stream *muxStream) SetReadDeadline(t time.Time) error {
+	stream.readDeadline.set(t)
+	return nil
+}
+
+func (stream *muxStream) SetWriteDeadline(t time.Time) error {
+	stream.writeDeadline.set(t)
+	return nil
+}
@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/nettest"
+)
+
+// newMuxSessionPair returns a pair of sessions connected in memory. Streams
+// opened by the first are accepted on the channel.
+func newMuxSessionPair() (s1, s2 *muxSession, accepted chan *muxStream, err error) {
+	dc1, dc2, err := newMemoryDataChannelPair()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	accepted = make(chan *muxStream, DefaultAcceptBacklog)
+	s1 = newMuxSession(dc1, true, func(*muxStream) bool { return false }, log.Logger)
+	s2 = newMuxSession(dc2, false, func(stream *muxStream) bool {
+		select {
+		case accepted <- stream:
+			return true
+		default:
+			return false
+		}
+	}, log.Logger)
+	return s1, s2, accepted, nil
+}
+
+func TestMuxNetConn(t *testing.T) {
+	nettest.TestConn(t, func() (c1, c2 net.Conn, stop func(), err error) {
+		s1, s2, accepted, err := newMuxSessionPair()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		stream, err := s1.open("rtctunnel:9000")
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return stream, <-accepted, func() {
+			_ = s1.Close()
+			_ = s2.Close()
+		}, nil
+	})
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	s1, s2, accepted, err := newMuxSessionPair()
+	assert.NoError(t, err)
+	defer s1.Close()
+	defer s2.Close()
+
+	blocked, err := s1.open("rtctunnel:1")
+	assert.NoError(t, err)
+	blockedPeer := <-accepted
+
+	// nothing reads the stream, so writes block once the window is full
+	assert.NoError(t, blocked.SetWriteDeadline(time.Now().Add(100*time.Millisecond)))
+	n, err := blocked.Write(make([]byte, 2*muxWindowSize))
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.Equal(t, muxWindowSize, n)
+
+	// but other streams keep working
+	stream, err := s1.open("rtctunnel:2")
+	assert.NoError(t, err)
+	peer := <-accepted
+	assert.Equal(t, "rtctunnel:2", peer.label)
+
+	data := make([]byte, 3*muxWindowSize)
+	go func() {
+		_, _ = stream.Write(data)
+		_ = stream.CloseWrite()
+	}()
+	received, err := io.ReadAll(peer)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), len(received))
+
+	// closing a stream unblocks the writer on the other side
+	assert.NoError(t, blocked.SetWriteDeadline(time.Time{}))
+	errc := make(chan error, 1)
+	go func() {
+		_, err := blocked.Write([]byte("blocked"))
+		errc <- err
+	}()
+	assert.NoError(t, blockedPeer.Close())
+	assert.ErrorIs(t, <-errc, ErrClosedByPeer)
+	_, err = blocked.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// TestMuxRejectWhilePeerBlocked makes sure rejecting streams doesn't block the
+// read loop while the peer isn't reading.
+func TestMuxRejectWhilePeerBlocked(t *testing.T) {
+	c1, c2 := net.Pipe()
+	s := newMuxSession(c1, true, func(*muxStream) bool { return false }, log.Logger)
+	defer s.Close()
+	defer c2.Close()
+
+	// c2 is never read, so the close frames for the rejected streams can't be
+	// sent
+	done := make(chan error, 1)
+	go func() {
+		for id := uint32(2); id <= 8; id += 2 {
+			frame := []byte{muxFrameOpen}
+			frame = binary.BigEndian.AppendUint32(frame, id)
+			frame = binary.BigEndian.AppendUint32(frame, 0)
+			_, err := c2.Write(frame)
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read loop blocked")
+	}
+}
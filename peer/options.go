@@ -1,5 +1,164 @@
 package peer
 
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/rtctunnel/rtctunnel/channels"
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/rtctunnel/rtctunnel/signal"
+)
+
+// DefaultHandshakeTimeout is the default time allowed for ICE to connect.
+const DefaultHandshakeTimeout = time.Minute
+
+// DefaultAcceptBacklog is the default number of connections that can wait to
+// be accepted.
+const DefaultAcceptBacklog = 128
+
 type dialConfig struct {
+	acceptBacklog       int
+	ctx                 context.Context
+	detachDataChannels  bool
+	handshakeTimeout    time.Duration
+	iceServers          []ICEServer
+	iceTransportPolicy  ICETransportPolicy
+	multiplex           bool
+	networkTypes        []NetworkType
+	peerPostQuantumKeys map[crypt.Key]crypt.PostQuantumKey
+	signalOptions       []signal.Option
+	logger              zerolog.Logger
 }
+
+// A DialOption customizes how a Conn is opened.
 type DialOption (func(*dialConfig))
+
+func getDialConfig(options ...DialOption) *dialConfig {
+	cfg := &dialConfig{
+		acceptBacklog:    DefaultAcceptBacklog,
+		ctx:              context.Background(),
+		handshakeTimeout: DefaultHandshakeTimeout,
+		logger:           log.Logger,
+	}
+	for _, o := range options {
+		o(cfg)
+	}
+	return cfg
+}
+
+// rtcOptions returns the options used to create RTCPeerConnections.
+func (cfg *dialConfig) rtcOptions() []RTCOption {
+	return []RTCOption{
+		WithRTCDetachedDataChannels(cfg.detachDataChannels),
+		WithRTCICEServers(cfg.iceServers...),
+		WithRTCICETransportPolicy(cfg.iceTransportPolicy),
+		WithRTCNetworkTypes(cfg.networkTypes...),
+	}
+}
+
+// WithAcceptBacklog sets how many connections opened by the peer can wait to
+// be accepted, including those still opening. Any more are rejected. Streams
+// and packet connections have separate backlogs. The default is
+// DefaultAcceptBacklog.
+func WithAcceptBacklog(backlog int) DialOption {
+	return func(cfg *dialConfig) {
+		if backlog > 0 {
+			cfg.acceptBacklog = backlog
+		}
+	}
+}
+
+// WithContext sets the context used to open the connection. Like
+// net.Dialer.DialContext, once the connection is open the context has no
+// effect.
+func WithContext(ctx context.Context) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.ctx = ctx
+	}
+}
+
+// WithDetachedDataChannels makes streams read and write the underlying data
+// channel directly instead of going through callbacks, which is considerably
+// faster. It's only supported by the native backend and ignored in the browser.
+func WithDetachedDataChannels() DialOption {
+	return func(cfg *dialConfig) {
+		cfg.detachDataChannels = true
+	}
+}
+
+// WithHandshakeTimeout sets the time allowed to gather ICE candidates, receive
+// the peer's answer and connect once signaling starts. Waiting for the peer to
+// come online isn't limited, use WithContext for that. The default is
+// DefaultHandshakeTimeout.
+func WithHandshakeTimeout(timeout time.Duration) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.handshakeTimeout = timeout
+	}
+}
+
+// WithICEServers sets the STUN and TURN servers used to establish the
+// connection. If no servers are set DefaultICEServers are used.
+func WithICEServers(servers ...ICEServer) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.iceServers = append(cfg.iceServers, servers...)
+	}
+}
+
+// WithICETransportPolicy sets which ICE candidates may be used. Use
+// ICETransportPolicyRelay to only connect through TURN servers.
+func WithICETransportPolicy(policy ICETransportPolicy) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.iceTransportPolicy = policy
+	}
+}
+
+// WithMultiplexing multiplexes streams over a single data channel, if the peer
+// supports it too. Opening a stream is much cheaper, since it doesn't need a
+// round trip or a new data channel.
+func WithMultiplexing() DialOption {
+	return func(cfg *dialConfig) {
+		cfg.multiplex = true
+	}
+}
+
+// WithNetworkTypes restricts the networks used for ICE candidates. By default
+// all networks are used.
+func WithNetworkTypes(networkTypes ...NetworkType) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.networkTypes = append(cfg.networkTypes, networkTypes...)
+	}
+}
+
+// WithPeerPostQuantumKey sets a peer's post-quantum key, so every signal message
+// sent to the peer uses hybrid encryption, including the first. Otherwise the
+// first message is only encrypted with X25519, and the peer's key is learned
+// from its reply.
+func WithPeerPostQuantumKey(peerPublicKey crypt.Key, key crypt.PostQuantumKey) DialOption {
+	return func(cfg *dialConfig) {
+		if cfg.peerPostQuantumKeys == nil {
+			cfg.peerPostQuantumKeys = make(map[crypt.Key]crypt.PostQuantumKey)
+		}
+		cfg.peerPostQuantumKeys[peerPublicKey] = key
+	}
+}
+
+// WithSignalChannel sets the channel used for signaling.
+func WithSignalChannel(ch channels.Channel) DialOption {
+	return WithSignalOptions(signal.WithChannel(ch))
+}
+
+// WithSignalOptions sets the options used for signaling.
+func WithSignalOptions(options ...signal.Option) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.signalOptions = append(cfg.signalOptions, options...)
+	}
+}
+
+// WithLogger sets the logger used by the connection.
+func WithLogger(logger zerolog.Logger) DialOption {
+	return func(cfg *dialConfig) {
+		cfg.logger = logger
+	}
+}
@@ -0,0 +1,256 @@
+package peer
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+)
+
+// packetQueueSize is how many received packets are kept until they're read.
+// Any more are dropped, like when a UDP socket's buffer is full.
+const packetQueueSize = 1024
+
+// ErrMessageTooLong is returned when writing a packet larger than the peer
+// supports.
+var ErrMessageTooLong = errors.New("message too long")
+
+// A PacketChannel implements the net.PacketConn interface over a webrtc data
+// channel. Each packet is sent as a single message, so packet boundaries are
+// kept. Like UDP, packets are dropped if they arrive faster than they're read
+// or if too much is queued to be sent.
+//
+// Packets are only ever exchanged with the peer, so the address passed to
+// WriteTo is ignored.
+type PacketChannel struct {
+	dc RTCDataChannel
+
+	// detached is set when the data channel is read and written directly
+	detached io.ReadWriteCloser
+
+	mu    sync.Mutex
+	queue [][]byte
+	// changed is closed and replaced whenever a packet is queued
+	changed chan struct{}
+
+	readDeadline, writeDeadline *deadline
+	// maxMessageSize is the largest packet sent
+	maxMessageSize int
+
+	localAddr, remoteAddr *Addr
+
+	// opened is set as soon as the data channel opens, before openCond
+	opened    atomic.Bool
+	openCond  *Cond
+	closeCond *Cond
+	closeErr  error
+}
+
+// WrapPacketChannel wraps an rtc data channel and implements the
+// net.PacketConn interface. The data channel should be unordered, with
+// retransmits disabled, see OpenPacket.
+func WrapPacketChannel(rtcDataChannel RTCDataChannel) (*PacketChannel, error) {
+	pc := newPacketChannel(rtcDataChannel)
+	err := pc.waitOpen()
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// newPacketChannel wraps an rtc data channel without waiting for it to open,
+// see newDataChannel.
+func newPacketChannel(rtcDataChannel RTCDataChannel) *PacketChannel {
+	pc := &PacketChannel{
+		dc: rtcDataChannel,
+
+		changed: make(chan struct{}),
+
+		readDeadline:   newDeadline(),
+		writeDeadline:  newDeadline(),
+		maxMessageSize: defaultMaxMessageSize,
+
+		openCond:  NewCond(),
+		closeCond: NewCond(),
+	}
+	pc.dc.OnClose(func() {
+		_ = pc.closeWithError(ErrClosedByPeer)
+	})
+	pc.dc.OnOpen(func() {
+		pc.opened.Store(true)
+		if detachable, ok := pc.dc.(DetachableRTCDataChannel); ok {
+			if rwc, err := detachable.Detach(); err == nil {
+				pc.detached = rwc
+				go pc.readDetached()
+			}
+		}
+		// see WrapDataChannel
+		time.Sleep(50 * time.Millisecond)
+		pc.openCond.Signal()
+	})
+	pc.dc.OnMessage(pc.receive)
+	return pc
+}
+
+// waitOpen waits for the data channel to open.
+func (pc *PacketChannel) waitOpen() error {
+	select {
+	case <-pc.closeCond.C:
+		if !pc.opened.Load() {
+			err := pc.closeErr
+			if err == nil {
+				err = errors.New("datachannel closed for unknown reasons")
+			}
+			return err
+		}
+		// see DataChannel.waitOpen
+		<-pc.openCond.C
+	case <-pc.openCond.C:
+	}
+
+	pc.localAddr = newAddr(pc.dc, crypt.Key{}, 0)
+	pc.remoteAddr = newAddr(pc.dc, crypt.Key{}, 0)
+
+	return nil
+}
+
+// receive queues a packet, or drops it if the queue is full.
+func (pc *PacketChannel) receive(data []byte) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if len(pc.queue) >= packetQueueSize {
+		return
+	}
+	pc.queue = append(pc.queue, data)
+	close(pc.changed)
+	pc.changed = make(chan struct{})
+}
+
+// readDetached reads packets from a detached data channel until it's closed.
+func (pc *PacketChannel) readDetached() {
+	buf := make([]byte, detachedReadBufferSize)
+	for {
+		n, err := pc.detached.Read(buf)
+		if err != nil {
+			_ = pc.closeWithError(ErrClosedByPeer)
+			return
+		}
+		pc.receive(append([]byte(nil), buf[:n]...))
+	}
+}
+
+// ReadFrom reads a packet from the peer. If b is too small for the packet,
+// the rest of it is discarded. Once the peer closes the data channel, ReadFrom
+// returns ErrClosedByPeer after the packets already received.
+func (pc *PacketChannel) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for {
+		closed := isClosedChan(pc.closeCond.C)
+		if closed && !errors.Is(pc.closeErr, ErrClosedByPeer) {
+			return 0, nil, net.ErrClosed
+		}
+		if isClosedChan(pc.readDeadline.done()) {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+
+		if len(pc.queue) > 0 {
+			n = copy(b, pc.queue[0])
+			pc.queue[0] = nil
+			pc.queue = pc.queue[1:]
+			return n, pc.remoteAddr, nil
+		}
+		if closed {
+			// packets received before the peer closed are still read
+			return 0, nil, ErrClosedByPeer
+		}
+
+		changed, deadline := pc.changed, pc.readDeadline.done()
+		pc.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+		case <-pc.closeCond.C:
+		}
+		pc.mu.Lock()
+	}
+}
+
+// WriteTo sends b to the peer as a single packet. The packet is dropped if
+// too much data is queued to be sent.
+func (pc *PacketChannel) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	select {
+	case <-pc.closeCond.C:
+		return 0, net.ErrClosed
+	case <-pc.writeDeadline.done():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	if len(b) > pc.maxMessageSize {
+		return 0, ErrMessageTooLong
+	}
+	if pc.dc.BufferedAmount() > dataChannelHighWaterMark {
+		return len(b), nil
+	}
+
+	if pc.detached != nil {
+		_, err = pc.detached.Write(b)
+	} else {
+		err = pc.dc.Send(b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (pc *PacketChannel) Close() error {
+	return pc.closeWithError(nil)
+}
+
+// LocalAddr returns the local address, an *Addr.
+func (pc *PacketChannel) LocalAddr() net.Addr {
+	return pc.localAddr
+}
+
+// RemoteAddr returns the remote address, an *Addr. It's the address of every
+// packet read.
+func (pc *PacketChannel) RemoteAddr() net.Addr {
+	return pc.remoteAddr
+}
+
+func (pc *PacketChannel) SetDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+func (pc *PacketChannel) SetReadDeadline(t time.Time) error {
+	pc.readDeadline.set(t)
+	return nil
+}
+
+func (pc *PacketChannel) SetWriteDeadline(t time.Time) error {
+	pc.writeDeadline.set(t)
+	return nil
+}
+
+func (pc *PacketChannel) closeWithError(err error) error {
+	pc.closeCond.Do(func() {
+		if err == nil {
+			err = pc.dc.Close()
+		} else {
+			_ = pc.dc.Close()
+		}
+		pc.closeErr = err
+	})
+	return err
+}
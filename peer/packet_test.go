@@ -0,0 +1,85 @@
+package peer
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryPacketChannelPair() (pc1, pc2 *PacketChannel, err error) {
+	fake1, fake2 := newMemoryRTCDataChannelPair()
+	var err1, err2 error
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		pc1, err1 = WrapPacketChannel(fake1)
+	}()
+	go func() {
+		defer wg.Done()
+		pc2, err2 = WrapPacketChannel(fake2)
+	}()
+	wg.Wait()
+	if err1 != nil {
+		return nil, nil, err1
+	} else if err2 != nil {
+		return nil, nil, err2
+	}
+	return pc1, pc2, nil
+}
+
+func TestPacketChannel(t *testing.T) {
+	pc1, pc2, err := newMemoryPacketChannelPair()
+	assert.NoError(t, err)
+	defer pc1.Close()
+	defer pc2.Close()
+	pc1.maxMessageSize = 1000
+
+	// packet boundaries are kept
+	for _, packet := range []string{"one", "", "three"} {
+		n, err := pc1.WriteTo([]byte(packet), nil)
+		assert.NoError(t, err)
+		assert.Equal(t, len(packet), n)
+	}
+	buf := make([]byte, 100)
+	for _, packet := range []string{"one", "", "three"} {
+		n, addr, err := pc2.ReadFrom(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, packet, string(buf[:n]))
+		assert.Equal(t, pc2.RemoteAddr(), addr)
+	}
+
+	// the rest of a packet is discarded if it doesn't fit
+	_, err = pc1.WriteTo([]byte("truncated"), nil)
+	assert.NoError(t, err)
+	_, err = pc1.WriteTo([]byte("next"), nil)
+	assert.NoError(t, err)
+	n, _, err := pc2.ReadFrom(buf[:5])
+	assert.NoError(t, err)
+	assert.Equal(t, "trunc", string(buf[:n]))
+	n, _, err = pc2.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "next", string(buf[:n]))
+
+	_, err = pc1.WriteTo(make([]byte, 1001), nil)
+	assert.ErrorIs(t, err, ErrMessageTooLong)
+
+	assert.NoError(t, pc2.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	_, _, err = pc2.ReadFrom(buf)
+	assert.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	assert.NoError(t, pc2.SetReadDeadline(time.Time{}))
+
+	// packets queued before the peer closes can still be read
+	_, err = pc1.WriteTo([]byte("last"), nil)
+	assert.NoError(t, err)
+	assert.NoError(t, pc1.Close())
+	n, _, err = pc2.ReadFrom(buf)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "last", string(buf[:n]))
+	}
+	_, _, err = pc2.ReadFrom(buf)
+	assert.ErrorIs(t, err, ErrClosedByPeer)
+}
@@ -0,0 +1,57 @@
+package peer
+
+import "time"
+
+// Stats are statistics about a peer connection.
+type Stats struct {
+	// LocalCandidate and RemoteCandidate are the selected ICE candidate pair,
+	// or nil if no pair is selected yet
+	LocalCandidate, RemoteCandidate *CandidateAddr
+	// RTT is the current round trip time over the selected candidate pair
+	RTT time.Duration
+	// BytesSent and BytesReceived are the totals sent over the ICE transport
+	BytesSent, BytesReceived uint64
+	DataChannels             []DataChannelStats
+	// Streams is the number of streams open, see Open and Accept
+	Streams int
+}
+
+// Relayed returns whether traffic to the peer goes through a TURN server.
+func (stats *Stats) Relayed() bool {
+	return (stats.LocalCandidate != nil && stats.LocalCandidate.Type == "relay") ||
+		(stats.RemoteCandidate != nil && stats.RemoteCandidate.Type == "relay")
+}
+
+// DataChannelStats are statistics about a data channel.
+type DataChannelStats struct {
+	Label string
+	// ID is the data channel id, or -1 if it isn't known yet
+	ID int
+	// State is "connecting", "open", "closing" or "closed"
+	State                          string
+	MessagesSent, MessagesReceived uint64
+	BytesSent, BytesReceived       uint64
+}
+
+// Stats returns statistics about the connection to the peer. It waits while
+// reconnecting.
+func (conn *Conn) Stats() (*Stats, error) {
+	l, err := conn.current()
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := l.pc.GetStats()
+	if err != nil {
+		return nil, err
+	}
+	for _, dc := range stats.DataChannels {
+		if _, ok := parseStreamLabel(dc.Label); ok && dc.State == "open" {
+			stats.Streams++
+		}
+	}
+	if l.mux != nil {
+		stats.Streams += l.mux.numStreams()
+	}
+	return stats, nil
+}
@@ -0,0 +1,111 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Protocols
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+const (
+	// targetLabelPrefix is the prefix of the labels of streams opened with
+	// OpenTarget. Older peers ignore them, since they don't match
+	// "rtctunnel:<port>".
+	targetLabelPrefix = "rtctunnel-open:"
+	// packetLabelPrefix is the prefix of the labels of packet connections.
+	// Older peers ignore them, since they don't match "rtctunnel:<port>".
+	packetLabelPrefix = "rtctunnel-packet:"
+)
+
+// A Target is what a stream or packet connection is opened to. It's sent to the
+// peer in the data channel label.
+type Target struct {
+	// Protocol is ProtocolTCP or ProtocolUDP. It's empty for streams from
+	// peers which only send a port.
+	Protocol string `json:"protocol,omitempty"`
+	// Service is the name of a service the peer maps to an address, instead of
+	// a port
+	Service string `json:"service,omitempty"`
+	Port    int    `json:"port,omitempty"`
+	// Metadata is passed to the peer as is
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// String returns the target as "<protocol>/<service or port>".
+func (target Target) String() string {
+	name := target.Service
+	if name == "" {
+		name = strconv.Itoa(target.Port)
+	}
+	if target.Protocol == "" {
+		return name
+	}
+	return target.Protocol + "/" + name
+}
+
+func (target Target) validate() error {
+	switch target.Protocol {
+	case "", ProtocolTCP, ProtocolUDP:
+	default:
+		return fmt.Errorf("invalid target protocol: %s", target.Protocol)
+	}
+	if target.Service == "" && target.Port == 0 {
+		return errors.New("invalid target: a service or port is required")
+	}
+	return nil
+}
+
+// label returns the data channel label for the target, using prefix.
+func (target Target) label(prefix string) string {
+	bs, _ := json.Marshal(target)
+	return prefix + string(bs)
+}
+
+// parseStreamLabel returns the target from a stream label. Older peers use
+// "rtctunnel:<port>" labels.
+func parseStreamLabel(label string) (target Target, ok bool) {
+	if s, ok := strings.CutPrefix(label, targetLabelPrefix); ok {
+		err := json.Unmarshal([]byte(s), &target)
+		return target, err == nil
+	}
+	port, ok := parseLabel(label)
+	return Target{Port: port}, ok
+}
+
+// parsePacketLabel returns the target from a packet connection label, either
+// "rtctunnel-packet:<port>" or "rtctunnel-packet:" followed by the target.
+func parsePacketLabel(label string) (target Target, ok bool) {
+	s, ok := strings.CutPrefix(label, packetLabelPrefix)
+	if !ok {
+		return target, false
+	}
+	if strings.HasPrefix(s, "{") {
+		err := json.Unmarshal([]byte(s), &target)
+		return target, err == nil
+	}
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return target, false
+	}
+	return Target{Protocol: ProtocolUDP, Port: port}, true
+}
+
+// parseLabel returns the port from an "rtctunnel:<port>" label.
+func parseLabel(label string) (port int, ok bool) {
+	idx := strings.LastIndexByte(label, ':')
+	if idx < 0 || label[:idx] != "rtctunnel" {
+		return 0, false
+	}
+	port, err := strconv.Atoi(label[idx+1:])
+	if err != nil {
+		return 0, false
+	}
+	return port, true
+}
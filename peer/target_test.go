@@ -0,0 +1,49 @@
+package peer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTargetLabels(t *testing.T) {
+	target := Target{
+		Protocol: ProtocolTCP,
+		Service:  "ssh",
+		Metadata: map[string]string{"user": "alice"},
+	}
+	parsed, ok := parseStreamLabel(target.label(targetLabelPrefix))
+	assert.True(t, ok)
+	assert.Equal(t, target, parsed)
+	assert.Equal(t, "tcp/ssh", target.String())
+
+	parsed, ok = parsePacketLabel(target.label(packetLabelPrefix))
+	assert.True(t, ok)
+	assert.Equal(t, target, parsed)
+
+	// labels from older peers
+	parsed, ok = parseStreamLabel("rtctunnel:22")
+	assert.True(t, ok)
+	assert.Equal(t, Target{Port: 22}, parsed)
+	assert.Equal(t, "22", parsed.String())
+
+	parsed, ok = parsePacketLabel("rtctunnel-packet:53")
+	assert.True(t, ok)
+	assert.Equal(t, Target{Protocol: ProtocolUDP, Port: 53}, parsed)
+
+	for _, label := range []string{"rtctunnel:init", "rtctunnel-open:{", "other:22", muxLabel} {
+		_, ok = parseStreamLabel(label)
+		assert.False(t, ok, label)
+	}
+	for _, label := range []string{"rtctunnel-packet:", "rtctunnel-packet:{", "rtctunnel:53"} {
+		_, ok = parsePacketLabel(label)
+		assert.False(t, ok, label)
+	}
+}
+
+func TestTargetValidate(t *testing.T) {
+	assert.NoError(t, Target{Port: 22}.validate())
+	assert.NoError(t, Target{Protocol: ProtocolUDP, Service: "dns"}.validate())
+	assert.Error(t, Target{Protocol: ProtocolTCP}.validate())
+	assert.Error(t, Target{Protocol: "sctp", Port: 22}.validate())
+}
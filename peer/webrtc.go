@@ -1,25 +1,210 @@
 package peer
 
+import (
+	"io"
+	"time"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+)
+
 // An RTCDataChannel abstracts an RTCDataChannel
 type RTCDataChannel interface {
+	// BufferedAmount is the number of bytes queued to be sent
+	BufferedAmount() uint64
 	Close() error
+	// ID returns the id of the data channel. ok is false until it's assigned.
+	ID() (id uint16, ok bool)
 	Label() string
+	OnBufferedAmountLow(func())
 	OnClose(func())
 	OnMessage(func([]byte))
 	OnOpen(func())
 	Send([]byte) error
+	// SetBufferedAmountLowThreshold sets the buffered amount at which the
+	// OnBufferedAmountLow handler is called
+	SetBufferedAmountLowThreshold(uint64)
+}
+
+// A DetachableRTCDataChannel can be read and written directly instead of
+// through OnMessage and Send. Only the native backend supports it, and only
+// when detached data channels are enabled.
+type DetachableRTCDataChannel interface {
+	RTCDataChannel
+	// Detach returns the underlying data channel. Each Read returns a single
+	// message. It must be called from the OnOpen handler.
+	Detach() (io.ReadWriteCloser, error)
 }
 
 // An RTCPeerConnection abstracts an RTCPeerConnection
 type RTCPeerConnection interface {
 	AddICECandidate(string) error
 	Close() error
-	CreateDataChannel(label string) (RTCDataChannel, error)
+	CreateDataChannel(label string, options ...DataChannelOption) (RTCDataChannel, error)
 	OnDataChannel(func(dc RTCDataChannel))
 	OnICECandidate(func(string))
 	OnICEConnectionStateChange(func(string))
 	CreateAnswer() (string, error)
+	// RemoteSDP returns the SDP of the remote description, or "" if it isn't
+	// set yet
+	RemoteSDP() string
 	CreateOffer() (string, error)
 	SetAnswer(answer string) error
 	SetOffer(offer string) error
+	// SelectedCandidatePair returns the local and remote ICE candidates in use
+	SelectedCandidatePair() (local, remote *CandidateAddr, err error)
+	// GetStats returns statistics about the connection. Streams isn't set.
+	GetStats() (*Stats, error)
+}
+
+// An ICEServer is a STUN or TURN server used to establish connections. TURN
+// over TCP or TLS is selected with the URL, for example
+// "turn:turn.example.com:3478?transport=tcp" or
+// "turns:turn.example.com:5349?transport=tcp".
+type ICEServer struct {
+	URLs []string
+	// Username and Credential authenticate with TURN servers
+	Username   string `json:",omitempty"`
+	Credential string `json:",omitempty"`
+}
+
+// DefaultICEServers are the ICE servers used when none are configured.
+var DefaultICEServers = []ICEServer{{
+	URLs: []string{
+		"stun:stun.l.google.com:19302",
+		"stun:stun1.l.google.com:19302",
+		"stun:stun2.l.google.com:19302",
+		"stun:stun3.l.google.com:19302",
+		"stun:stun4.l.google.com:19302",
+	},
+}}
+
+// An ICETransportPolicy restricts which ICE candidates are used.
+type ICETransportPolicy string
+
+// ICETransportPolicies
+const (
+	ICETransportPolicyAll   ICETransportPolicy = "all"
+	ICETransportPolicyRelay ICETransportPolicy = "relay"
+)
+
+// A NetworkType is a network used for ICE candidates.
+type NetworkType string
+
+// NetworkTypes
+const (
+	NetworkTypeUDP4 NetworkType = "udp4"
+	NetworkTypeUDP6 NetworkType = "udp6"
+	NetworkTypeTCP4 NetworkType = "tcp4"
+	NetworkTypeTCP6 NetworkType = "tcp6"
+	// NetworkTypeTCP is both tcp4 and tcp6
+	NetworkTypeTCP NetworkType = "tcp"
+)
+
+type rtcConfig struct {
+	certificateKeyPair *crypt.KeyPair
+	detachDataChannels bool
+	iceServers         []ICEServer
+	iceTransportPolicy ICETransportPolicy
+	networkTypes       []NetworkType
+}
+
+// An RTCOption customizes an RTCPeerConnection.
+type RTCOption func(cfg *rtcConfig)
+
+// WithCertificateKeyPair derives a stable DTLS certificate from the key pair
+// instead of generating a new one for every connection. It's ignored in the
+// browser, which always generates its own certificate.
+func WithCertificateKeyPair(keypair crypt.KeyPair) RTCOption {
+	return func(cfg *rtcConfig) {
+		cfg.certificateKeyPair = &keypair
+	}
+}
+
+// WithRTCDetachedDataChannels enables detached data channels, see
+// DetachableRTCDataChannel. It's ignored in the browser.
+func WithRTCDetachedDataChannels(enabled bool) RTCOption {
+	return func(cfg *rtcConfig) {
+		cfg.detachDataChannels = enabled
+	}
+}
+
+// WithRTCICEServers sets the ICE servers. If no servers are set
+// DefaultICEServers are used.
+func WithRTCICEServers(servers ...ICEServer) RTCOption {
+	return func(cfg *rtcConfig) {
+		cfg.iceServers = append(cfg.iceServers, servers...)
+	}
+}
+
+// WithRTCICETransportPolicy sets which ICE candidates may be used.
+func WithRTCICETransportPolicy(policy ICETransportPolicy) RTCOption {
+	return func(cfg *rtcConfig) {
+		cfg.iceTransportPolicy = policy
+	}
+}
+
+// WithRTCNetworkTypes restricts the networks used for ICE candidates. It's
+// ignored in the browser, which doesn't allow restricting them.
+func WithRTCNetworkTypes(networkTypes ...NetworkType) RTCOption {
+	return func(cfg *rtcConfig) {
+		cfg.networkTypes = append(cfg.networkTypes, networkTypes...)
+	}
+}
+
+type dataChannelConfig struct {
+	ordered           bool
+	maxRetransmits    *uint16
+	maxPacketLifeTime *time.Duration
+}
+
+// A DataChannelOption customizes an RTCDataChannel.
+type DataChannelOption func(cfg *dataChannelConfig)
+
+// WithDataChannelOrdered sets whether messages are delivered in order. By
+// default they are.
+func WithDataChannelOrdered(ordered bool) DataChannelOption {
+	return func(cfg *dataChannelConfig) {
+		cfg.ordered = ordered
+	}
+}
+
+// WithDataChannelMaxRetransmits limits how many times a message is
+// retransmitted before it's dropped. By default messages are always
+// retransmitted.
+func WithDataChannelMaxRetransmits(maxRetransmits uint16) DataChannelOption {
+	return func(cfg *dataChannelConfig) {
+		cfg.maxRetransmits = &maxRetransmits
+		cfg.maxPacketLifeTime = nil
+	}
+}
+
+// WithDataChannelMaxPacketLifeTime limits how long a message is retransmitted
+// for before it's dropped. It has millisecond precision.
+func WithDataChannelMaxPacketLifeTime(maxPacketLifeTime time.Duration) DataChannelOption {
+	return func(cfg *dataChannelConfig) {
+		cfg.maxPacketLifeTime = &maxPacketLifeTime
+		cfg.maxRetransmits = nil
+	}
+}
+
+func getDataChannelConfig(options ...DataChannelOption) *dataChannelConfig {
+	cfg := &dataChannelConfig{ordered: true}
+	for _, o := range options {
+		o(cfg)
+	}
+	return cfg
+}
+
+func getRTCConfig(options ...RTCOption) *rtcConfig {
+	cfg := new(rtcConfig)
+	for _, o := range options {
+		o(cfg)
+	}
+	if len(cfg.iceServers) == 0 {
+		cfg.iceServers = DefaultICEServers
+	}
+	if cfg.iceTransportPolicy == "" {
+		cfg.iceTransportPolicy = ICETransportPolicyAll
+	}
+	return cfg
 }
@@ -7,10 +7,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"time"
 
 	"syscall/js"
 )
 
+// maxMessageSize is the largest message sent, browsers may not support larger
+// messages even if the remote peer does
+const maxMessageSize = 256 * 1024
+
 type M = map[string]interface{}
 type S = []interface{}
 
@@ -18,15 +24,35 @@ type jsRTCDataChannel struct {
 	object js.Value
 }
 
+func (dc jsRTCDataChannel) BufferedAmount() uint64 {
+	return uint64(dc.object.Get("bufferedAmount").Int())
+}
+
 func (dc jsRTCDataChannel) Close() error {
 	dc.object.Call("close")
 	return nil
 }
 
+func (dc jsRTCDataChannel) ID() (id uint16, ok bool) {
+	v := dc.object.Get("id")
+	if v.Type() != js.TypeNumber {
+		return 0, false
+	}
+	return uint16(v.Int()), true
+}
+
 func (dc jsRTCDataChannel) Label() string {
 	return dc.object.Get("label").String()
 }
 
+func (dc jsRTCDataChannel) OnBufferedAmountLow(handler func()) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		go handler()
+		return js.Undefined()
+	})
+	dc.object.Set("onbufferedamountlow", f)
+}
+
 func (dc jsRTCDataChannel) OnClose(handler func()) {
 	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 		go handler()
@@ -64,6 +90,10 @@ func (dc jsRTCDataChannel) Send(data []byte) error {
 	})
 }
 
+func (dc jsRTCDataChannel) SetBufferedAmountLowThreshold(threshold uint64) {
+	dc.object.Set("bufferedAmountLowThreshold", threshold)
+}
+
 type jsRTCPeerConnection struct {
 	object           js.Value
 	negotiationready *Cond
@@ -85,8 +115,22 @@ func (pc *jsRTCPeerConnection) Close() error {
 	})
 }
 
-func (pc *jsRTCPeerConnection) CreateDataChannel(label string) (RTCDataChannel, error) {
-	dc := pc.object.Call("createDataChannel", label)
+func (pc *jsRTCPeerConnection) CreateDataChannel(label string, options ...DataChannelOption) (RTCDataChannel, error) {
+	cfg := getDataChannelConfig(options...)
+	init := M{"ordered": cfg.ordered}
+	if cfg.maxRetransmits != nil {
+		init["maxRetransmits"] = *cfg.maxRetransmits
+	}
+	if cfg.maxPacketLifeTime != nil {
+		init["maxPacketLifeTime"] = cfg.maxPacketLifeTime.Milliseconds()
+	}
+	var dc js.Value
+	err := jsExceptionToGoError(func() {
+		dc = pc.object.Call("createDataChannel", label, init)
+	})
+	if err != nil {
+		return nil, err
+	}
 	consolelog("RTCPeerConnection::CreateDataChannel::result", dc)
 	return jsRTCDataChannel{dc}, nil
 }
@@ -136,6 +180,148 @@ func (pc *jsRTCPeerConnection) CreateOffer() (string, error) {
 	return pc.handleLocalSDPPromise(promise)
 }
 
+func (pc *jsRTCPeerConnection) RemoteSDP() string {
+	desc := pc.object.Get("remoteDescription")
+	if !desc.Truthy() {
+		return ""
+	}
+	return desc.Get("sdp").String()
+}
+
+func (pc *jsRTCPeerConnection) SelectedCandidatePair() (local, remote *CandidateAddr, err error) {
+	// not every browser supports getSelectedCandidatePair
+	sctp := pc.object.Get("sctp")
+	if !sctp.Truthy() {
+		return nil, nil, errors.New("no sctp transport")
+	}
+	iceTransport := sctp.Get("transport").Get("iceTransport")
+	if !iceTransport.Truthy() || iceTransport.Get("getSelectedCandidatePair").Type() != js.TypeFunction {
+		return nil, nil, errors.New("selected candidate pair not supported")
+	}
+	pair := iceTransport.Call("getSelectedCandidatePair")
+	if !pair.Truthy() {
+		return nil, nil, errors.New("no selected candidate pair")
+	}
+	return jsCandidateAddr(pair.Get("local")), jsCandidateAddr(pair.Get("remote")), nil
+}
+
+func jsCandidateAddr(candidate js.Value) *CandidateAddr {
+	addr := &CandidateAddr{
+		Protocol: candidate.Get("protocol").String(),
+		Address:  candidate.Get("address").String(),
+		Type:     candidate.Get("type").String(),
+	}
+	if port := candidate.Get("port"); port.Type() == js.TypeNumber {
+		addr.Port = port.Int()
+	}
+	return addr
+}
+
+func (pc *jsRTCPeerConnection) GetStats() (*Stats, error) {
+	reportc := make(chan js.Value, 1)
+	errc := make(chan error, 1)
+	pc.object.Call("getStats").
+		Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			report := args[0]
+			go func() {
+				reportc <- report
+			}()
+			return nil
+		})).
+		Call("catch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			err := args[0]
+			go func() {
+				errc <- errors.New(err.String())
+			}()
+			return nil
+		}))
+
+	var report js.Value
+	select {
+	case report = <-reportc:
+	case err := <-errc:
+		return nil, err
+	case <-pc.closed.C:
+		return nil, errors.New("closed")
+	}
+
+	entries := map[string]js.Value{}
+	report.Call("forEach", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		entries[args[0].Get("id").String()] = args[0]
+		return nil
+	}))
+
+	stats := new(Stats)
+	var pair js.Value
+	for _, entry := range entries {
+		switch entry.Get("type").String() {
+		case "transport":
+			if id := entry.Get("selectedCandidatePairId"); id.Truthy() {
+				pair = entries[id.String()]
+			}
+			stats.BytesSent = uint64(jsNumber(entry.Get("bytesSent")))
+			stats.BytesReceived = uint64(jsNumber(entry.Get("bytesReceived")))
+		case "candidate-pair":
+			// firefox marks the selected pair instead
+			if entry.Get("selected").Truthy() && !pair.Truthy() {
+				pair = entry
+			}
+		case "data-channel":
+			id := -1
+			if v := entry.Get("dataChannelIdentifier"); v.Type() == js.TypeNumber {
+				id = v.Int()
+			}
+			stats.DataChannels = append(stats.DataChannels, DataChannelStats{
+				Label:            entry.Get("label").String(),
+				ID:               id,
+				State:            entry.Get("state").String(),
+				MessagesSent:     uint64(jsNumber(entry.Get("messagesSent"))),
+				MessagesReceived: uint64(jsNumber(entry.Get("messagesReceived"))),
+				BytesSent:        uint64(jsNumber(entry.Get("bytesSent"))),
+				BytesReceived:    uint64(jsNumber(entry.Get("bytesReceived"))),
+			})
+		}
+	}
+	sort.Slice(stats.DataChannels, func(i, j int) bool {
+		return stats.DataChannels[i].ID < stats.DataChannels[j].ID
+	})
+
+	if pair.Truthy() {
+		if local := entries[pair.Get("localCandidateId").String()]; local.Truthy() {
+			stats.LocalCandidate = jsStatsCandidateAddr(local)
+		}
+		if remote := entries[pair.Get("remoteCandidateId").String()]; remote.Truthy() {
+			stats.RemoteCandidate = jsStatsCandidateAddr(remote)
+		}
+		stats.RTT = time.Duration(jsNumber(pair.Get("currentRoundTripTime")) * float64(time.Second))
+	}
+	return stats, nil
+}
+
+// jsStatsCandidateAddr returns the address of a local-candidate or
+// remote-candidate stats entry.
+func jsStatsCandidateAddr(candidate js.Value) *CandidateAddr {
+	addr := &CandidateAddr{
+		Protocol: candidate.Get("protocol").String(),
+		Type:     candidate.Get("candidateType").String(),
+		Port:     int(jsNumber(candidate.Get("port"))),
+	}
+	if address := candidate.Get("address"); address.Truthy() {
+		addr.Address = address.String()
+	} else {
+		addr.Address = candidate.Get("ip").String()
+	}
+	return addr
+}
+
+// jsNumber returns v if it's a number, or 0.
+func jsNumber(v js.Value) float64 {
+	if v.Type() != js.TypeNumber {
+		return 0
+	}
+	return v.Float()
+}
+
 func (pc *jsRTCPeerConnection) SetAnswer(answer string) error {
 	consolelog("RTCPeerConnection::SetAnswer", answer)
 	promise := pc.object.Call("setRemoteDescription", M{
@@ -202,13 +388,28 @@ func (pc *jsRTCPeerConnection) handleLocalSDPPromise(promise js.Value) (string,
 	}
 }
 
-func NewRTCPeerConnection() (RTCPeerConnection, error) {
+func NewRTCPeerConnection(options ...RTCOption) (RTCPeerConnection, error) {
+	cfg := getRTCConfig(options...)
+
+	iceServers := S{}
+	for _, server := range cfg.iceServers {
+		urls := S{}
+		for _, url := range server.URLs {
+			urls = append(urls, url)
+		}
+		iceServer := M{"urls": urls}
+		if server.Username != "" {
+			iceServer["username"] = server.Username
+		}
+		if server.Credential != "" {
+			iceServer["credential"] = server.Credential
+		}
+		iceServers = append(iceServers, iceServer)
+	}
+
 	obj := js.Global().Get("RTCPeerConnection").New(M{
-		"iceServers": S{
-			M{
-				"urls": "stun:stun.l.google.com:19302",
-			},
-		},
+		"iceServers":         iceServers,
+		"iceTransportPolicy": string(cfg.iceTransportPolicy),
 	})
 	pc := &jsRTCPeerConnection{
 		object:           obj,
@@ -229,12 +430,9 @@ func NewRTCPeerConnection() (RTCPeerConnection, error) {
 		return nil
 	}))
 	obj.Set("onconnectionstatechange", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		// failures are reported through oniceconnectionstatechange so the
+		// connection can be re-established
 		consolelog("RTCPeerConnection::onconnectionstatechange", args[0].Get("target").Get("connectionState"))
-		cs := args[0].Get("target").Get("connectionState").String()
-		switch cs {
-		case "failed", "disconnected":
-			pc.Close()
-		}
 		return nil
 	}))
 	return pc, nil
@@ -3,25 +3,62 @@
 package peer
 
 import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	webrtc "github.com/pion/webrtc/v3"
 	"github.com/pkg/errors"
+	"github.com/rtctunnel/rtctunnel/crypt"
 )
 
+// maxMessageSize is the largest message sent, regardless of what the remote
+// peer supports. pion can't receive larger messages.
+const maxMessageSize = 65535
+
 type nativeRTCDataChannel struct {
 	native *webrtc.DataChannel
 }
 
+func (dc nativeRTCDataChannel) BufferedAmount() uint64 {
+	return dc.native.BufferedAmount()
+}
+
 func (dc nativeRTCDataChannel) Close() error {
 	return dc.native.Close()
 }
 
+func (dc nativeRTCDataChannel) Detach() (io.ReadWriteCloser, error) {
+	return dc.native.Detach()
+}
+
+func (dc nativeRTCDataChannel) ID() (id uint16, ok bool) {
+	if ptr := dc.native.ID(); ptr != nil {
+		return *ptr, true
+	}
+	return 0, false
+}
+
 func (dc nativeRTCDataChannel) Label() string {
 	return dc.native.Label()
 }
 
+func (dc nativeRTCDataChannel) OnBufferedAmountLow(handler func()) {
+	dc.native.OnBufferedAmountLow(handler)
+}
+
 func (dc nativeRTCDataChannel) OnClose(handler func()) {
 	dc.native.OnClose(handler)
 }
@@ -42,6 +79,10 @@ func (dc nativeRTCDataChannel) Send(data []byte) error {
 	return dc.native.Send(data)
 }
 
+func (dc nativeRTCDataChannel) SetBufferedAmountLowThreshold(threshold uint64) {
+	dc.native.SetBufferedAmountLowThreshold(threshold)
+}
+
 type nativeRTCPeerConnection struct {
 	*webrtc.PeerConnection
 }
@@ -55,8 +96,17 @@ func (pc nativeRTCPeerConnection) AddICECandidate(candidate string) error {
 	return pc.PeerConnection.AddICECandidate(obj)
 }
 
-func (pc nativeRTCPeerConnection) CreateDataChannel(label string) (RTCDataChannel, error) {
-	dc, err := pc.PeerConnection.CreateDataChannel(label, nil)
+func (pc nativeRTCPeerConnection) CreateDataChannel(label string, options ...DataChannelOption) (RTCDataChannel, error) {
+	cfg := getDataChannelConfig(options...)
+	init := &webrtc.DataChannelInit{
+		Ordered:        &cfg.ordered,
+		MaxRetransmits: cfg.maxRetransmits,
+	}
+	if cfg.maxPacketLifeTime != nil {
+		ms := uint16(min(cfg.maxPacketLifeTime.Milliseconds(), math.MaxUint16))
+		init.MaxPacketLifeTime = &ms
+	}
+	dc, err := pc.PeerConnection.CreateDataChannel(label, init)
 	if err != nil {
 		return nil, err
 	}
@@ -110,6 +160,77 @@ func (pc nativeRTCPeerConnection) CreateOffer() (string, error) {
 	return sdp.SDP, nil
 }
 
+func (pc nativeRTCPeerConnection) RemoteSDP() string {
+	desc := pc.PeerConnection.RemoteDescription()
+	if desc == nil {
+		return ""
+	}
+	return desc.SDP
+}
+
+func (pc nativeRTCPeerConnection) SelectedCandidatePair() (local, remote *CandidateAddr, err error) {
+	sctp := pc.PeerConnection.SCTP()
+	if sctp == nil {
+		return nil, nil, errors.New("no sctp transport")
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil {
+		return nil, nil, err
+	} else if pair == nil {
+		return nil, nil, errors.New("no selected candidate pair")
+	}
+	return nativeCandidateAddr(pair.Local), nativeCandidateAddr(pair.Remote), nil
+}
+
+func (pc nativeRTCPeerConnection) GetStats() (*Stats, error) {
+	stats := new(Stats)
+	if sctp := pc.PeerConnection.SCTP(); sctp != nil {
+		iceTransport := sctp.Transport().ICETransport()
+		if pair, err := iceTransport.GetSelectedCandidatePair(); err == nil && pair != nil {
+			stats.LocalCandidate = nativeCandidateAddr(pair.Local)
+			stats.RemoteCandidate = nativeCandidateAddr(pair.Remote)
+		}
+		if pairStats, ok := iceTransport.GetSelectedCandidatePairStats(); ok {
+			stats.RTT = time.Duration(pairStats.CurrentRoundTripTime * float64(time.Second))
+		}
+	}
+
+	for _, s := range pc.PeerConnection.GetStats() {
+		switch s := s.(type) {
+		case webrtc.TransportStats:
+			stats.BytesSent = s.BytesSent
+			stats.BytesReceived = s.BytesReceived
+		case webrtc.DataChannelStats:
+			id := -1
+			if s.State != webrtc.DataChannelStateConnecting {
+				id = int(s.DataChannelIdentifier)
+			}
+			stats.DataChannels = append(stats.DataChannels, DataChannelStats{
+				Label:            s.Label,
+				ID:               id,
+				State:            s.State.String(),
+				MessagesSent:     uint64(s.MessagesSent),
+				MessagesReceived: uint64(s.MessagesReceived),
+				BytesSent:        s.BytesSent,
+				BytesReceived:    s.BytesReceived,
+			})
+		}
+	}
+	sort.Slice(stats.DataChannels, func(i, j int) bool {
+		return stats.DataChannels[i].ID < stats.DataChannels[j].ID
+	})
+	return stats, nil
+}
+
+func nativeCandidateAddr(candidate *webrtc.ICECandidate) *CandidateAddr {
+	return &CandidateAddr{
+		Protocol: candidate.Protocol.String(),
+		Address:  candidate.Address,
+		Port:     int(candidate.Port),
+		Type:     candidate.Typ.String(),
+	}
+}
+
 func (pc nativeRTCPeerConnection) SetAnswer(answer string) error {
 	return pc.PeerConnection.SetRemoteDescription(webrtc.SessionDescription{
 		Type: webrtc.SDPTypeAnswer,
@@ -124,20 +245,114 @@ func (pc nativeRTCPeerConnection) SetOffer(offer string) error {
 	})
 }
 
-func NewRTCPeerConnection() (RTCPeerConnection, error) {
-	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{{
-			URLs: []string{
-				"stun:stun.l.google.com:19302",
-				"stun:stun1.l.google.com:19302",
-				"stun:stun2.l.google.com:19302",
-				"stun:stun3.l.google.com:19302",
-				"stun:stun4.l.google.com:19302",
-			},
-		}},
-	})
+func NewRTCPeerConnection(options ...RTCOption) (RTCPeerConnection, error) {
+	cfg := getRTCConfig(options...)
+
+	var config webrtc.Configuration
+	for _, server := range cfg.iceServers {
+		iceServer := webrtc.ICEServer{
+			URLs:     server.URLs,
+			Username: server.Username,
+		}
+		if server.Credential != "" {
+			iceServer.Credential = server.Credential
+			iceServer.CredentialType = webrtc.ICECredentialTypePassword
+		}
+		config.ICEServers = append(config.ICEServers, iceServer)
+	}
+	switch cfg.iceTransportPolicy {
+	case ICETransportPolicyAll:
+		config.ICETransportPolicy = webrtc.ICETransportPolicyAll
+	case ICETransportPolicyRelay:
+		config.ICETransportPolicy = webrtc.ICETransportPolicyRelay
+	default:
+		return nil, errors.Errorf("unknown ice transport policy: %s", cfg.iceTransportPolicy)
+	}
+	if cfg.certificateKeyPair != nil {
+		certificate, err := certificateForKeyPair(*cfg.certificateKeyPair)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error creating certificate")
+		}
+		config.Certificates = []webrtc.Certificate{*certificate}
+	}
+
+	var se webrtc.SettingEngine
+	if cfg.detachDataChannels {
+		se.DetachDataChannels()
+	}
+	if len(cfg.networkTypes) > 0 {
+		var networkTypes []webrtc.NetworkType
+		for _, networkType := range cfg.networkTypes {
+			switch networkType {
+			case NetworkTypeUDP4:
+				networkTypes = append(networkTypes, webrtc.NetworkTypeUDP4)
+			case NetworkTypeUDP6:
+				networkTypes = append(networkTypes, webrtc.NetworkTypeUDP6)
+			case NetworkTypeTCP4:
+				networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4)
+			case NetworkTypeTCP6:
+				networkTypes = append(networkTypes, webrtc.NetworkTypeTCP6)
+			case NetworkTypeTCP:
+				networkTypes = append(networkTypes, webrtc.NetworkTypeTCP4, webrtc.NetworkTypeTCP6)
+			default:
+				return nil, errors.Errorf("unknown network type: %s", networkType)
+			}
+		}
+		se.SetNetworkTypes(networkTypes)
+	}
+
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(se))
+	pc, err := api.NewPeerConnection(config)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error creating peer connection")
 	}
 	return nativeRTCPeerConnection{pc}, nil
 }
+
+var certificates sync.Map
+
+// certificateForKeyPair deterministically derives a DTLS certificate from a key
+// pair, so the certificate fingerprint is the same every time.
+func certificateForKeyPair(keypair crypt.KeyPair) (*webrtc.Certificate, error) {
+	if certificate, ok := certificates.Load(keypair.Public); ok {
+		return certificate.(*webrtc.Certificate), nil
+	}
+
+	var ecdhKey *ecdh.PrivateKey
+	for i := 0; ecdhKey == nil; i++ {
+		seed := keypair.DeriveSecret(fmt.Sprintf("rtctunnel dtls certificate key v1 %d", i), 32)
+		// fails if the seed is out of range, so just try the next one
+		ecdhKey, _ = ecdh.P256().NewPrivateKey(seed)
+	}
+	pub := ecdhKey.PublicKey().Bytes()
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:]),
+		},
+		D: new(big.Int).SetBytes(ecdhKey.Bytes()),
+	}
+
+	serial := sha256.Sum256(keypair.Public[:])
+	template := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(serial[:16]),
+		Subject:               pkix.Name{CommonName: "rtctunnel"},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Date(2120, 1, 1, 0, 0, 0, 0, time.UTC),
+		BasicConstraintsValid: true,
+	}
+	// a nil random produces a deterministic signature
+	der, err := x509.CreateCertificate(nil, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	certificate := webrtc.CertificateFromX509(key, cert)
+	certificates.Store(keypair.Public, &certificate)
+	return &certificate, nil
+}
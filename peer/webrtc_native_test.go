@@ -0,0 +1,54 @@
+//go:build !js
+// +build !js
+
+package peer
+
+import (
+	"testing"
+
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCertificateForKeyPair(t *testing.T) {
+	keypair := crypt.GenerateKeyPair()
+
+	c1, err := certificateForKeyPair(keypair)
+	assert.NoError(t, err)
+	certificates.Delete(keypair.Public)
+	c2, err := certificateForKeyPair(keypair)
+	assert.NoError(t, err)
+
+	f1, err := c1.GetFingerprints()
+	assert.NoError(t, err)
+	f2, err := c2.GetFingerprints()
+	assert.NoError(t, err)
+	assert.Equal(t, f1, f2, "the certificate should be the same for the same key pair")
+
+	c3, err := certificateForKeyPair(crypt.GenerateKeyPair())
+	assert.NoError(t, err)
+	f3, err := c3.GetFingerprints()
+	assert.NoError(t, err)
+	assert.NotEqual(t, f1, f3)
+}
+
+func TestICEServers(t *testing.T) {
+	pc, err := NewRTCPeerConnection(WithRTCICEServers(
+		ICEServer{URLs: []string{"stun:stun.example.com:3478"}},
+		ICEServer{
+			URLs: []string{
+				"turn:turn.example.com:3478?transport=tcp",
+				"turns:turn.example.com:5349?transport=tcp",
+			},
+			Username:   "user",
+			Credential: "secret",
+		},
+	))
+	assert.NoError(t, err)
+	assert.NoError(t, pc.Close())
+
+	_, err = NewRTCPeerConnection(WithRTCICEServers(ICEServer{
+		URLs: []string{"turn:turn.example.com:3478"},
+	}))
+	assert.Error(t, err, "turn servers require credentials")
+}
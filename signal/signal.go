@@ -1,6 +1,9 @@
 package signal
 
 import (
+	"context"
+	"strings"
+
 	"github.com/mr-tron/base58"
 	"github.com/rtctunnel/rtctunnel/channels"
 	_ "github.com/rtctunnel/rtctunnel/channels/apprtc"   // for the default apprtc channel
@@ -8,8 +11,14 @@ import (
 	"github.com/rtctunnel/rtctunnel/crypt"
 )
 
+// hybridPrefix marks messages encrypted with crypt.KeyPair.EncryptHybrid.
+const hybridPrefix = "pq1:"
+
 type config struct {
-	channel channels.Channel
+	channel            channels.Channel
+	topic              string
+	peerPostQuantumKey crypt.PostQuantumKey
+	session            *crypt.Session
 }
 
 var defaultOptions = []Option{
@@ -33,6 +42,14 @@ func getConfig(options ...Option) (*config, error) {
 	return cfg, nil
 }
 
+func (cfg *config) address(to, from crypt.Key) string {
+	address := to.String() + "/" + from.String()
+	if cfg.topic != "" {
+		address += "/" + cfg.topic
+	}
+	return address
+}
+
 // An Option customizes the config.
 type Option func(cfg *config) error
 
@@ -44,38 +61,107 @@ func WithChannel(ch channels.Channel) Option {
 	}
 }
 
+// WithTopic sets the topic option. Messages sent on a topic are only received
+// by a Recv for the same topic, so unrelated exchanges with a peer don't
+// interfere with each other.
+func WithTopic(topic string) Option {
+	return func(cfg *config) error {
+		cfg.topic = topic
+		return nil
+	}
+}
+
+// WithPostQuantumKey sets the peer's post-quantum key. When set, messages are
+// sent using hybrid X25519 and ML-KEM-768 encryption. Recv accepts both kinds of
+// messages regardless.
+func WithPostQuantumKey(key crypt.PostQuantumKey) Option {
+	return func(cfg *config) error {
+		cfg.peerPostQuantumKey = key
+		return nil
+	}
+}
+
+// WithSession sets the session option. When the session's key pair is the one
+// used to send or receive, its cached shared keys are used instead of
+// recomputing them for every message.
+func WithSession(session *crypt.Session) Option {
+	return func(cfg *config) error {
+		cfg.session = session
+		return nil
+	}
+}
+
 // SetDefaultOptions sets the default options
 func SetDefaultOptions(options ...Option) {
 	defaultOptions = options
 }
 
+// Channel returns the channel messages are sent over.
+func Channel(options ...Option) (channels.Channel, error) {
+	cfg, err := getConfig(options...)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.channel, nil
+}
+
 // Send sends a message to a peer. Messages are encrypted and authenticated.
 func Send(keypair crypt.KeyPair, peerPublicKey crypt.Key, data []byte, options ...Option) error {
 	cfg, err := getConfig(options...)
 	if err != nil {
 		return err
 	}
-	encrypted := keypair.Encrypt(peerPublicKey, data)
-	address := peerPublicKey.String() + "/" + keypair.Public.String()
-	encoded := base58.Encode(encrypted)
+	address := cfg.address(peerPublicKey, keypair.Public)
+	var encoded string
+	if cfg.peerPostQuantumKey != nil {
+		encrypted, err := keypair.EncryptHybrid(peerPublicKey, cfg.peerPostQuantumKey, data)
+		if err != nil {
+			return err
+		}
+		encoded = hybridPrefix + base58.Encode(encrypted)
+	} else if cfg.session != nil && cfg.session.PublicKey() == keypair.Public {
+		encrypted, err := cfg.session.Encrypt(peerPublicKey, data)
+		if err != nil {
+			return err
+		}
+		encoded = base58.Encode(encrypted)
+	} else {
+		encrypted := keypair.Encrypt(peerPublicKey, data)
+		encoded = base58.Encode(encrypted)
+	}
 	return cfg.channel.Send(address, encoded)
 }
 
 // Recv receives a message from a peer. Messages are encrypted and authenticated.
 func Recv(keypair crypt.KeyPair, peerPublicKey crypt.Key, options ...Option) (data []byte, err error) {
+	return RecvContext(context.Background(), keypair, peerPublicKey, options...)
+}
+
+// RecvContext is like Recv, but stops waiting for a message when ctx is done.
+func RecvContext(ctx context.Context, keypair crypt.KeyPair, peerPublicKey crypt.Key, options ...Option) (data []byte, err error) {
 	cfg, err := getConfig(options...)
 	if err != nil {
 		return nil, err
 	}
-	address := keypair.Public.String() + "/" + peerPublicKey.String()
-	encoded, err := cfg.channel.Recv(address)
+	address := cfg.address(keypair.Public, peerPublicKey)
+	encoded, err := channels.RecvContext(ctx, cfg.channel, address)
 	if err != nil {
 		return nil, err
 	}
+	if strings.HasPrefix(encoded, hybridPrefix) {
+		decoded, err := base58.Decode(encoded[len(hybridPrefix):])
+		if err != nil {
+			return nil, err
+		}
+		return keypair.DecryptHybrid(peerPublicKey, decoded)
+	}
 	decoded, err := base58.Decode(encoded)
 	if err != nil {
 		return nil, err
 	}
+	if cfg.session != nil && cfg.session.PublicKey() == keypair.Public {
+		return cfg.session.Decrypt(peerPublicKey, decoded)
+	}
 	decrypted, err := keypair.Decrypt(peerPublicKey, decoded)
 	if err != nil {
 		return nil, err
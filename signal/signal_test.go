@@ -0,0 +1,55 @@
+package signal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rtctunnel/rtctunnel/channels"
+	"github.com/rtctunnel/rtctunnel/crypt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendRecv(t *testing.T) {
+	ch, err := channels.Get("memory://signal-test")
+	assert.NoError(t, err)
+
+	k1 := crypt.GenerateKeyPair()
+	k2 := crypt.GenerateKeyPair()
+
+	assert.NoError(t, Send(k1, k2.Public, []byte("classic"), WithChannel(ch)))
+	data, err := Recv(k2, k1.Public, WithChannel(ch))
+	assert.NoError(t, err)
+	assert.Equal(t, "classic", string(data))
+
+	assert.NoError(t, Send(k1, k2.Public, []byte("hybrid"), WithChannel(ch), WithPostQuantumKey(k2.PostQuantumKey())))
+	encoded, err := ch.Recv(k2.Public.String() + "/" + k1.Public.String())
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encoded, hybridPrefix))
+	assert.NoError(t, ch.Send(k2.Public.String()+"/"+k1.Public.String(), encoded))
+	data, err = Recv(k2, k1.Public, WithChannel(ch))
+	assert.NoError(t, err)
+	assert.Equal(t, "hybrid", string(data))
+}
+
+func TestSession(t *testing.T) {
+	ch, err := channels.Get("memory://signal-session-test")
+	assert.NoError(t, err)
+
+	k1 := crypt.GenerateKeyPair()
+	k2 := crypt.GenerateKeyPair()
+	s1 := crypt.NewSession(k1)
+	defer s1.Close()
+	s2 := crypt.NewSession(k2)
+	defer s2.Close()
+
+	assert.NoError(t, Send(k1, k2.Public, []byte("hello"), WithChannel(ch), WithSession(s1)))
+	data, err := Recv(k2, k1.Public, WithChannel(ch), WithSession(s2))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// sessions for other key pairs are ignored
+	assert.NoError(t, Send(k2, k1.Public, []byte("world"), WithChannel(ch), WithSession(s2)))
+	data, err = Recv(k1, k2.Public, WithChannel(ch), WithSession(s2))
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+}